@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -11,35 +12,62 @@ import (
 	ristretto_store "github.com/eko/gocache/store/ristretto/v4"
 	rueidis_store "github.com/eko/gocache/store/rueidis/v4"
 	"github.com/redis/rueidis"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/fx"
 
 	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+	bolt_store "github.com/wei840222/ory-oathkeeper-login/store/bolt"
 )
 
-func NewCache() (cache.CacheInterface[string], error) {
+func NewCache(lc fx.Lifecycle, mp metric.MeterProvider, health *server.Health) (cache.CacheInterface[string], error) {
 	var s store.StoreInterface
 
 	if viper.GetString(config.KeyCacheRedisHost) != "" {
-		rueidisClient, err := rueidis.NewClient(rueidis.ClientOption{
-			InitAddress: []string{fmt.Sprintf("%s:%d", viper.GetString(config.KeyCacheRedisHost), viper.GetInt(config.KeyCacheRedisPort))},
-			Password:    viper.GetString(config.KeyCacheRedisPassword),
-			SelectDB:    viper.GetInt(config.KeyCacheRedisDB),
-		})
+		rueidisClient, err := newRedisClient()
 		if err != nil {
 			return nil, err
 		}
 
+		health.Register("cache.redis", true, func(ctx context.Context) error {
+			return rueidisClient.Do(ctx, rueidisClient.B().Ping().Build()).Error()
+		})
+
 		s = rueidis_store.NewRueidis(rueidisClient, store.WithClientSideCaching(15*time.Second))
+	} else if viper.GetString(config.KeyCacheBoltPath) != "" {
+		boltStore, err := bolt_store.NewBolt(viper.GetString(config.KeyCacheBoltPath))
+		if err != nil {
+			return nil, err
+		}
+		maintainBoltStore(lc, boltStore)
+		health.Register("cache.bolt", true, boltStore.Ping)
+
+		s = boltStore
 	} else {
 		ristrettoCache, err := ristretto.NewCache(&ristretto.Config{
-			NumCounters: 1000,
-			MaxCost:     100,
-			BufferItems: 64,
+			NumCounters: viper.GetInt64(config.KeyCacheMemoryNumCounters),
+			MaxCost:     viper.GetInt64(config.KeyCacheMemoryMaxCost),
+			BufferItems: viper.GetInt64(config.KeyCacheMemoryBufferItems),
+			Metrics:     true,
+			// entries are set with cost 0, so ristretto falls back to this to weigh them by size
+			Cost: func(value any) int64 {
+				if v, ok := value.(string); ok {
+					return int64(len(v))
+				}
+				return 1
+			},
 		})
 		if err != nil {
 			return nil, err
 		}
 
+		if err := registerRistrettoMetrics(mp, ristrettoCache.Metrics); err != nil {
+			return nil, err
+		}
+		watchRistrettoHitRatio(lc, ristrettoCache.Metrics)
+
 		s = ristretto_store.NewRistretto(ristrettoCache)
 	}
 
@@ -48,3 +76,154 @@ func NewCache() (cache.CacheInterface[string], error) {
 
 	return cache.NewMetric(p, c), nil
 }
+
+func newRedisClient() (rueidis.Client, error) {
+	return rueidis.NewClient(rueidis.ClientOption{
+		InitAddress: []string{fmt.Sprintf("%s:%d", viper.GetString(config.KeyCacheRedisHost), viper.GetInt(config.KeyCacheRedisPort))},
+		SelectDB:    viper.GetInt(config.KeyCacheRedisDB),
+		// resolved on every new connection so a rotated password file is picked up on reconnect
+		AuthCredentialsFn: func(rueidis.AuthCredentialsContext) (rueidis.AuthCredentials, error) {
+			password, err := config.Secret(config.KeyCacheRedisPassword)
+			return rueidis.AuthCredentials{Password: password}, err
+		},
+	})
+}
+
+func registerRistrettoMetrics(mp metric.MeterProvider, m *ristretto.Metrics) error {
+	meter := mp.Meter(config.AppName)
+
+	admissions, err := meter.Int64ObservableCounter("cache.memory.admissions", metric.WithDescription("Number of entries admitted into the in-memory cache"))
+	if err != nil {
+		return err
+	}
+	rejections, err := meter.Int64ObservableCounter("cache.memory.rejections", metric.WithDescription("Number of entries rejected by the in-memory cache admission policy"))
+	if err != nil {
+		return err
+	}
+	evictions, err := meter.Int64ObservableCounter("cache.memory.evictions", metric.WithDescription("Number of entries evicted from the in-memory cache"))
+	if err != nil {
+		return err
+	}
+	size, err := meter.Int64ObservableGauge("cache.memory.size", metric.WithDescription("Total cost of entries held by the in-memory cache"), metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(admissions, int64(m.KeysAdded()))
+		o.ObserveInt64(rejections, int64(m.SetsRejected()))
+		o.ObserveInt64(evictions, int64(m.KeysEvicted()))
+		o.ObserveInt64(size, int64(m.CostAdded()-m.CostEvicted()))
+		return nil
+	}, admissions, rejections, evictions, size)
+
+	return err
+}
+
+func watchRistrettoHitRatio(lc fx.Lifecycle, m *ristretto.Metrics) {
+	logger := log.With().Str("logger", "cache").Logger()
+	interval := viper.GetDuration(config.KeyCacheMemoryHitRatioInterval)
+	threshold := viper.GetFloat64(config.KeyCacheMemoryHitRatioThreshold)
+	if interval <= 0 || threshold <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+
+				var lastHits, lastMisses, lastEvictions uint64
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+					}
+
+					hits, misses, evictions := m.Hits(), m.Misses(), m.KeysEvicted()
+					deltaHits, deltaMisses, deltaEvictions := hits-lastHits, misses-lastMisses, evictions-lastEvictions
+					lastHits, lastMisses, lastEvictions = hits, misses, evictions
+
+					if deltaHits+deltaMisses == 0 {
+						continue
+					}
+					ratio := float64(deltaHits) / float64(deltaHits+deltaMisses)
+					if ratio < threshold {
+						logger.Warn().
+							Float64("ratio", ratio).
+							Float64("threshold", threshold).
+							Uint64("hits", deltaHits).
+							Uint64("misses", deltaMisses).
+							Uint64("evictions", deltaEvictions).
+							Msgf("in-memory cache hit ratio collapsed in the last %s, consider raising %s", interval, config.KeyCacheMemoryMaxCost)
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			close(done)
+			return nil
+		},
+	})
+}
+
+func maintainBoltStore(lc fx.Lifecycle, s *bolt_store.BoltStore) {
+	logger := log.With().Str("logger", "cache").Logger()
+	sweepInterval := viper.GetDuration(config.KeyCacheBoltSweepInterval)
+	compactInterval := viper.GetDuration(config.KeyCacheBoltCompactInterval)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(stopped)
+
+				var sweep, compact <-chan time.Time
+				if sweepInterval > 0 {
+					t := time.NewTicker(sweepInterval)
+					defer t.Stop()
+					sweep = t.C
+				}
+				if compactInterval > 0 {
+					t := time.NewTicker(compactInterval)
+					defer t.Stop()
+					compact = t.C
+				}
+
+				for {
+					select {
+					case <-done:
+						return
+					case <-sweep:
+						removed, err := s.Sweep(context.Background())
+						if err != nil {
+							logger.Warn().Err(err).Msg("bolt store sweep failed")
+							continue
+						}
+						logger.Debug().Int("removed", removed).Msg("bolt store expired entries swept")
+					case <-compact:
+						before, after, err := s.Compact(context.Background())
+						if err != nil {
+							logger.Warn().Err(err).Msg("bolt store compaction failed")
+							continue
+						}
+						logger.Info().Int64("before", before).Int64("after", after).Msg("bolt store compacted")
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			close(done)
+			<-stopped
+			return s.Close()
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration.",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration.",
+	Long:  `Load the configuration from the same sources as the server and report unknown keys, missing required values, malformed URLs and bad durations.`,
+	// the problems are printed as they are found and main prints the summary
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		if err := config.InitViper(); err != nil {
+			return err
+		}
+		config.InitCobraPFlag(cmd)
+
+		if file := viper.ConfigFileUsed(); file != "" {
+			fmt.Fprintf(cmd.OutOrStdout(), "config file: %s\n", file)
+		} else {
+			fmt.Fprintln(cmd.OutOrStdout(), "config file: none found")
+		}
+		files, err := config.DropInFiles(viper.GetViper())
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			fmt.Fprintf(cmd.OutOrStdout(), "config file: %s\n", file)
+		}
+
+		var problems int
+		for _, key := range config.UnknownKeys(viper.GetViper()) {
+			fmt.Fprintf(cmd.OutOrStdout(), "unknown key: %s\n", key)
+			problems++
+		}
+
+		if err := config.Validate(viper.GetViper()); err != nil {
+			var joined interface{ Unwrap() []error }
+			if errors.As(err, &joined) {
+				for _, err := range joined.Unwrap() {
+					fmt.Fprintf(cmd.OutOrStdout(), "invalid: %s\n", err)
+					problems++
+				}
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "invalid: %s\n", err)
+				problems++
+			}
+		}
+
+		if problems > 0 {
+			return fmt.Errorf("found %d problem(s) in the configuration", problems)
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), "configuration is valid")
+		return nil
+	},
+}
+
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema of the configuration file.",
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		config.InitCobraPFlag(cmd)
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(config.JSONSchema())
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd, configSchemaCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -4,6 +4,7 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -17,23 +18,93 @@ var (
 
 		KeyO11yHost,
 		KeyO11yPort,
+		KeyO11yListen,
+		KeyO11yProbeInterval,
+		KeyO11yProbeTimeout,
+
+		KeyTraceExporter,
+		KeyTraceEndpoint,
+		KeyTraceInsecure,
+		KeyTraceHeaders,
+		KeyTraceSampleRatio,
+
+		KeyRateLimitBackend,
+		KeyRateLimitLoginIP,
+		KeyRateLimitLoginSubject,
+		KeyRateLimitLoginProvider,
+		KeyRateLimitSessionIP,
+		KeyRateLimitSessionSubject,
+		KeyRateLimitSessionProvider,
+
+		KeyAuditSink,
+		KeyAuditIncludeCacheHits,
+		KeyAuditBufferSize,
+		KeyAuditFilePath,
+		KeyAuditFileMaxSize,
+		KeyAuditFileMaxBackups,
+		KeyAuditFileMaxAge,
+		KeyAuditFileCompress,
+		KeyAuditWebhookURL,
+		KeyAuditWebhookHeaders,
+		KeyAuditWebhookBatchSize,
+		KeyAuditWebhookFlushInterval,
+		KeyAuditWebhookRetryCount,
+		KeyAuditWebhookTimeout,
+
+		KeyAdminToken,
+		KeyAdminTokenFile,
+		KeyAdminClientSubjects,
+		KeyAdminRevocationTTL,
+
+		KeyShutdownDrainDelay,
+		KeyShutdownTimeout,
 
 		KeyGinMode,
 
 		KeyHTTPPort,
 		KeyHTTPHost,
+		KeyHTTPListen,
+		KeySubjectHeader,
+		KeyHTTPTrustedProxies,
+		KeyHTTPTemplateDir,
+		KeyHTTPTLSCertFile,
+		KeyHTTPTLSKeyFile,
+		KeyHTTPTLSMinVersion,
+		KeyHTTPTLSClientCAFile,
+		KeyHTTPTLSClientSubjects,
 
 		KeyCacheRedisHost,
 		KeyCacheRedisPort,
 		KeyCacheRedisDB,
 		KeyCacheRedisPassword,
+		KeyCacheRedisPasswordFile,
 
 		KeyCacheTTL,
+
+		KeyCacheBoltPath,
+		KeyCacheBoltSweepInterval,
+		KeyCacheBoltCompactInterval,
+
+		KeyCacheMemoryNumCounters,
+		KeyCacheMemoryMaxCost,
+		KeyCacheMemoryBufferItems,
+		KeyCacheMemoryHitRatioThreshold,
+		KeyCacheMemoryHitRatioInterval,
 	}
 )
 
-func InitCobraPFlag(cmd *cobra.Command) {
+var flags *pflag.FlagSet
+
+func bindPFlags(v *viper.Viper) {
+	if flags == nil {
+		return
+	}
 	for _, key := range AllKeys {
-		viper.BindPFlag(key, cmd.Flags().Lookup(FlagReplacer.Replace(key)))
+		v.BindPFlag(key, flags.Lookup(FlagReplacer.Replace(key)))
 	}
 }
+
+func InitCobraPFlag(cmd *cobra.Command) {
+	flags = cmd.Flags()
+	bindPFlags(viper.GetViper())
+}
@@ -8,39 +8,136 @@ const (
 	KeyLogFormat = "log.format"
 	KeyLogColor  = "log.color"
 
-	KeyO11yHost = "o11y.host"
-	KeyO11yPort = "o11y.port"
+	KeyO11yHost   = "o11y.host"
+	KeyO11yPort   = "o11y.port"
+	KeyO11yListen = "o11y.listen"
+
+	KeyO11yProbeInterval = "o11y.probe_interval"
+	KeyO11yProbeTimeout  = "o11y.probe_timeout"
+
+	KeyTraceExporter    = "trace.exporter"
+	KeyTraceEndpoint    = "trace.endpoint"
+	KeyTraceInsecure    = "trace.insecure"
+	KeyTraceHeaders     = "trace.headers"
+	KeyTraceSampleRatio = "trace.sample_ratio"
+
+	TraceExporterOTLPGRPC = "otlp_grpc"
+	TraceExporterOTLPHTTP = "otlp_http"
+	TraceExporterStdout   = "stdout"
+	TraceExporterNone     = "none"
+
+	KeyAuditSink             = "audit.sink"
+	KeyAuditIncludeCacheHits = "audit.include_cache_hits"
+	KeyAuditBufferSize       = "audit.buffer_size"
+
+	KeyAuditFilePath       = "audit.file.path"
+	KeyAuditFileMaxSize    = "audit.file.max_size"
+	KeyAuditFileMaxBackups = "audit.file.max_backups"
+	KeyAuditFileMaxAge     = "audit.file.max_age"
+	KeyAuditFileCompress   = "audit.file.compress"
+
+	KeyAuditWebhookURL           = "audit.webhook.url"
+	KeyAuditWebhookHeaders       = "audit.webhook.headers"
+	KeyAuditWebhookBatchSize     = "audit.webhook.batch_size"
+	KeyAuditWebhookFlushInterval = "audit.webhook.flush_interval"
+	KeyAuditWebhookRetryCount    = "audit.webhook.retry_count"
+	KeyAuditWebhookTimeout       = "audit.webhook.timeout"
+
+	AuditSinkNone    = "none"
+	AuditSinkStdout  = "stdout"
+	AuditSinkFile    = "file"
+	AuditSinkWebhook = "webhook"
+
+	KeyRateLimitBackend         = "ratelimit.backend"
+	KeyRateLimitLoginIP         = "ratelimit.login.ip"
+	KeyRateLimitLoginSubject    = "ratelimit.login.subject"
+	KeyRateLimitLoginProvider   = "ratelimit.login.provider"
+	KeyRateLimitSessionIP       = "ratelimit.session.ip"
+	KeyRateLimitSessionSubject  = "ratelimit.session.subject"
+	KeyRateLimitSessionProvider = "ratelimit.session.provider"
+
+	RateLimitBackendMemory = "memory"
+	RateLimitBackendRedis  = "redis"
+
+	KeyAdminToken          = "admin.token"
+	KeyAdminTokenFile      = "admin.token_file"
+	KeyAdminClientSubjects = "admin.client_subjects"
+	KeyAdminRevocationTTL  = "admin.revocation_ttl"
+
+	KeyShutdownDrainDelay = "shutdown.drain_delay"
+	KeyShutdownTimeout    = "shutdown.timeout"
 
 	KeyGinMode = "gin.mode"
 
-	KeyHTTPPort = "http.port"
-	KeyHTTPHost = "http.host"
+	KeyHTTPPort   = "http.port"
+	KeyHTTPHost   = "http.host"
+	KeyHTTPListen = "http.listen"
+
+	KeySubjectHeader      = "http.subject_header"
+	KeyHTTPTrustedProxies = "http.trusted_proxies"
+	KeyHTTPTemplateDir    = "http.template_dir"
+
+	KeyHTTPTLSCertFile       = "http.tls.cert_file"
+	KeyHTTPTLSKeyFile        = "http.tls.key_file"
+	KeyHTTPTLSMinVersion     = "http.tls.min_version"
+	KeyHTTPTLSClientCAFile   = "http.tls.client_ca_file"
+	KeyHTTPTLSClientSubjects = "http.tls.client_subjects"
 
 	KeyCacheTTL = "cache.ttl"
 
-	KeyCacheRedisHost     = "cache.redis.host"
-	KeyCacheRedisPort     = "cache.redis.port"
-	KeyCacheRedisDB       = "cache.redis.db"
-	KeyCacheRedisPassword = "cache.redis.password"
+	KeyCacheBoltPath            = "cache.bolt.path"
+	KeyCacheBoltSweepInterval   = "cache.bolt.sweep_interval"
+	KeyCacheBoltCompactInterval = "cache.bolt.compact_interval"
+
+	KeyCacheMemoryNumCounters       = "cache.memory.num_counters"
+	KeyCacheMemoryMaxCost           = "cache.memory.max_cost"
+	KeyCacheMemoryBufferItems       = "cache.memory.buffer_items"
+	KeyCacheMemoryHitRatioThreshold = "cache.memory.hit_ratio_threshold"
+	KeyCacheMemoryHitRatioInterval  = "cache.memory.hit_ratio_interval"
+
+	KeyCacheRedisHost         = "cache.redis.host"
+	KeyCacheRedisPort         = "cache.redis.port"
+	KeyCacheRedisDB           = "cache.redis.db"
+	KeyCacheRedisPassword     = "cache.redis.password"
+	KeyCacheRedisPasswordFile = "cache.redis.password_file"
+
+	KeyVaultAddress          = "vault.address"
+	KeyVaultNamespace        = "vault.namespace"
+	KeyVaultCAFile           = "vault.ca_file"
+	KeyVaultToken            = "vault.token"
+	KeyVaultTokenFile        = "vault.token_file"
+	KeyVaultAuthMethod       = "vault.auth.method"
+	KeyVaultAuthMount        = "vault.auth.mount"
+	KeyVaultAuthRole         = "vault.auth.role"
+	KeyVaultAuthJWTFile      = "vault.auth.jwt_file"
+	KeyVaultAuthRoleID       = "vault.auth.role_id"
+	KeyVaultAuthSecretID     = "vault.auth.secret_id"
+	KeyVaultAuthSecretIDFile = "vault.auth.secret_id_file"
+	KeyVaultRefreshInterval  = "vault.refresh_interval"
 
-	KeyProxmoxServerURL = "proxmox.server_url"
-	KeyProxmoxUsername  = "proxmox.username"
-	KeyProxmoxPassword  = "proxmox.password"
+	KeyProxmoxServerURL    = "proxmox.server_url"
+	KeyProxmoxUsername     = "proxmox.username"
+	KeyProxmoxPassword     = "proxmox.password"
+	KeyProxmoxPasswordFile = "proxmox.password_file"
 
-	KeyArgoCDServerURL = "argo_cd.server_url"
-	KeyArgoCDUsername  = "argo_cd.username"
-	KeyArgoCDPassword  = "argo_cd.password"
+	KeyArgoCDServerURL    = "argo_cd.server_url"
+	KeyArgoCDUsername     = "argo_cd.username"
+	KeyArgoCDPassword     = "argo_cd.password"
+	KeyArgoCDPasswordFile = "argo_cd.password_file"
 
-	KeyGhostServerURL = "ghost.server_url"
-	KeyGhostOriginURL = "ghost.origin_url"
-	KeyGhostUsername  = "ghost.username"
-	KeyGhostPassword  = "ghost.password"
+	KeyGhostServerURL    = "ghost.server_url"
+	KeyGhostOriginURL    = "ghost.origin_url"
+	KeyGhostUsername     = "ghost.username"
+	KeyGhostPassword     = "ghost.password"
+	KeyGhostPasswordFile = "ghost.password_file"
 
-	KeyN8NServerURL = "n8n.server_url"
-	KeyN8NUsername  = "n8n.username"
-	KeyN8NPassword  = "n8n.password"
+	KeyN8NServerURL    = "n8n.server_url"
+	KeyN8NUsername     = "n8n.username"
+	KeyN8NPassword     = "n8n.password"
+	KeyN8NPasswordFile = "n8n.password_file"
 
-	KeyNocoDBServerURL = "nocodb.server_url"
-	KeyNocoDBUsername  = "nocodb.username"
-	KeyNocoDBPassword  = "nocodb.password"
+	KeyNocoDBServerURL    = "nocodb.server_url"
+	KeyNocoDBUsername     = "nocodb.username"
+	KeyNocoDBPassword     = "nocodb.password"
+	KeyNocoDBPasswordFile = "nocodb.password_file"
 )
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	ListenNetworkTCP     = "tcp"
+	ListenNetworkUnix    = "unix"
+	ListenNetworkSystemd = "systemd"
+)
+
+var (
+	HTTPRouteGroups = []string{"login", "session"}
+	O11yRouteGroups = []string{"health", "livez", "readyz", "status", "metrics", "debug", "admin"}
+)
+
+// ListenAddress is a listener of an HTTP server written as a URL, e.g.
+// tcp://0.0.0.0:8080, unix:///run/login/session.sock?mode=0660&route=session
+// or systemd://http for a socket passed by systemd socket activation.
+type ListenAddress struct {
+	URL     string
+	Network string
+	// host:port, socket path or systemd file descriptor name
+	Address string
+	// Mode and Group of a Unix socket file
+	Mode  os.FileMode
+	Group string
+	// Routes are the first path segments served on the listener, every
+	// route when empty.
+	Routes []string
+	// TLS is served when the server has a certificate, by default on TCP
+	// and systemd listeners of the HTTP server.
+	TLS bool
+}
+
+func ParseListenAddress(s string, tlsByDefault bool) (ListenAddress, error) {
+	if !strings.Contains(s, "://") {
+		s = ListenNetworkTCP + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ListenAddress{}, err
+	}
+
+	addr := ListenAddress{URL: s, Network: u.Scheme, TLS: tlsByDefault && u.Scheme != ListenNetworkUnix}
+	switch u.Scheme {
+	case ListenNetworkTCP, ListenNetworkSystemd:
+		addr.Address = u.Host
+	case ListenNetworkUnix:
+		addr.Address = u.Path
+	default:
+		return ListenAddress{}, fmt.Errorf("%q: unsupported network %q, use tcp, unix or systemd", s, u.Scheme)
+	}
+	if addr.Address == "" {
+		return ListenAddress{}, fmt.Errorf("%q: missing address", s)
+	}
+
+	q := u.Query()
+	if mode := q.Get("mode"); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || addr.Network != ListenNetworkUnix {
+			return ListenAddress{}, fmt.Errorf("%q: mode must be an octal permission of a unix socket", s)
+		}
+		addr.Mode = os.FileMode(m)
+	}
+	if addr.Group = q.Get("group"); addr.Group != "" && addr.Network != ListenNetworkUnix {
+		return ListenAddress{}, fmt.Errorf("%q: group only applies to a unix socket", s)
+	}
+	// repeated rather than comma separated, lists of flags are split on commas
+	addr.Routes = q["route"]
+	if t := q.Get("tls"); t != "" {
+		if addr.TLS, err = strconv.ParseBool(t); err != nil {
+			return ListenAddress{}, fmt.Errorf("%q: tls must be true or false", s)
+		}
+	}
+
+	return addr, nil
+}
+
+// ListenAddresses returns the listeners configured under key, or a TCP
+// listener on host and port when there are none.
+func ListenAddresses(v *viper.Viper, key, hostKey, portKey string, routeGroups []string, tlsByDefault bool) ([]ListenAddress, error) {
+	urls := v.GetStringSlice(key)
+	if len(urls) == 0 {
+		urls = []string{fmt.Sprintf("%s://%s:%d", ListenNetworkTCP, v.GetString(hostKey), v.GetInt(portKey))}
+	}
+
+	addrs := make([]ListenAddress, 0, len(urls))
+	for i, s := range urls {
+		addr, err := ParseListenAddress(s, tlsByDefault)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", key, i, err)
+		}
+		for _, route := range addr.Routes {
+			if !slices.Contains(routeGroups, route) {
+				return nil, fmt.Errorf("%s[%d]: unknown route %q, use %s", key, i, route, strings.Join(routeGroups, ", "))
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
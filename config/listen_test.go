@@ -0,0 +1,121 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		raw          string
+		tlsByDefault bool
+		want         ListenAddress
+		wantErr      string
+	}{
+		{
+			raw:          "0.0.0.0:8080",
+			tlsByDefault: true,
+			want:         ListenAddress{URL: "tcp://0.0.0.0:8080", Network: ListenNetworkTCP, Address: "0.0.0.0:8080", TLS: true},
+		},
+		{
+			raw:  "tcp://[::1]:9090?route=metrics&route=readyz",
+			want: ListenAddress{URL: "tcp://[::1]:9090?route=metrics&route=readyz", Network: ListenNetworkTCP, Address: "[::1]:9090", Routes: []string{"metrics", "readyz"}},
+		},
+		{
+			raw:          "tcp://0.0.0.0:8080?tls=false",
+			tlsByDefault: true,
+			want:         ListenAddress{URL: "tcp://0.0.0.0:8080?tls=false", Network: ListenNetworkTCP, Address: "0.0.0.0:8080"},
+		},
+		{
+			raw:  "tcp://0.0.0.0:9090?tls=true",
+			want: ListenAddress{URL: "tcp://0.0.0.0:9090?tls=true", Network: ListenNetworkTCP, Address: "0.0.0.0:9090", TLS: true},
+		},
+		{
+			raw:          "unix:///run/login/session.sock?mode=0660&group=oathkeeper&route=session",
+			tlsByDefault: true,
+			want: ListenAddress{
+				URL:     "unix:///run/login/session.sock?mode=0660&group=oathkeeper&route=session",
+				Network: ListenNetworkUnix,
+				Address: "/run/login/session.sock",
+				Mode:    0o660,
+				Group:   "oathkeeper",
+				Routes:  []string{"session"},
+			},
+		},
+		{
+			raw:          "systemd://http",
+			tlsByDefault: true,
+			want:         ListenAddress{URL: "systemd://http", Network: ListenNetworkSystemd, Address: "http", TLS: true},
+		},
+		{raw: "udp://0.0.0.0:8080", wantErr: "unsupported network"},
+		{raw: "unix://", wantErr: "missing address"},
+		{raw: "systemd://", wantErr: "missing address"},
+		{raw: "unix:///run/a.sock?mode=rw", wantErr: "octal permission"},
+		{raw: "unix:///run/a.sock?mode=0999", wantErr: "octal permission"},
+		{raw: "tcp://0.0.0.0:8080?mode=0660", wantErr: "octal permission"},
+		{raw: "tcp://0.0.0.0:8080?group=www", wantErr: "group only applies"},
+		{raw: "tcp://0.0.0.0:8080?tls=maybe", wantErr: "tls must be true or false"},
+		{raw: "tcp://0.0.0.0:8080/%zz", wantErr: "invalid URL escape"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseListenAddress(tt.raw, tt.tlsByDefault)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseListenAddress() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseListenAddress() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		listen  []string
+		want    []string
+		wantErr string
+	}{
+		{name: "host and port", want: []string{"tcp://127.0.0.1:8080"}},
+		{name: "listeners", listen: []string{"tcp://0.0.0.0:8443", "unix:///run/a.sock?route=session"}, want: []string{"tcp://0.0.0.0:8443", "unix:///run/a.sock?route=session"}},
+		{name: "unknown route", listen: []string{"tcp://0.0.0.0:8443", "tcp://0.0.0.0:8080?route=metrics"}, wantErr: `http.listen[1]: unknown route "metrics"`},
+		{name: "invalid listener", listen: []string{"udp://0.0.0.0:8080"}, wantErr: "http.listen[0]: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set(KeyHTTPHost, "127.0.0.1")
+			v.Set(KeyHTTPPort, 8080)
+			v.Set(KeyHTTPListen, tt.listen)
+
+			addrs, err := ListenAddresses(v, KeyHTTPListen, KeyHTTPHost, KeyHTTPPort, HTTPRouteGroups, true)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("ListenAddresses() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, addr := range addrs {
+				got = append(got, addr.URL)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListenAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
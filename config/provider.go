@@ -0,0 +1,127 @@
+package config
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	ProviderProxmox = "proxmox"
+	ProviderArgoCD  = "argo_cd"
+	ProviderGhost   = "ghost"
+	ProviderN8N     = "n8n"
+	ProviderNocoDB  = "nocodb"
+
+	KeySuffixServerURL           = "server_url"
+	KeySuffixServerURLs          = "server_urls"
+	KeySuffixBalancing           = "balancing"
+	KeySuffixHealthCheckInterval = "health_check.interval"
+
+	KeySuffixTimeoutConnect = "timeout.connect"
+	KeySuffixTimeoutRequest = "timeout.request"
+
+	KeySuffixRetryCount   = "retry.count"
+	KeySuffixRetryWait    = "retry.wait"
+	KeySuffixRetryMaxWait = "retry.max_wait"
+
+	KeySuffixCircuitBreakerFailureThreshold = "circuit_breaker.failure_threshold"
+	KeySuffixCircuitBreakerOpenDuration     = "circuit_breaker.open_duration"
+
+	KeySuffixLockoutThreshold   = "lockout.threshold"
+	KeySuffixLockoutCooldown    = "lockout.cooldown"
+	KeySuffixLockoutMaxCooldown = "lockout.max_cooldown"
+
+	KeySuffixLoginInterstitial = "login.interstitial"
+
+	KeySuffixTLSCAFile             = "tls.ca_file"
+	KeySuffixTLSCertFile           = "tls.cert_file"
+	KeySuffixTLSKeyFile            = "tls.key_file"
+	KeySuffixTLSServerName         = "tls.server_name"
+	KeySuffixTLSMinVersion         = "tls.min_version"
+	KeySuffixTLSInsecureSkipVerify = "tls.insecure_skip_verify"
+
+	KeySuffixProxyURL          = "proxy.url"
+	KeySuffixProxyUsername     = "proxy.username"
+	KeySuffixProxyPassword     = "proxy.password"
+	KeySuffixProxyPasswordFile = "proxy.password_file"
+	KeySuffixProxyNoProxy      = "proxy.no_proxy"
+
+	KeySuffixSessionPolicy            = "session.policy"
+	KeySuffixSessionGrace             = "session.grace"
+	KeySuffixSessionFailOpenAllowlist = "session.fail_open_allowlist"
+
+	SessionPolicyFailClosed           = "fail_closed"
+	SessionPolicyStaleWhileRevalidate = "stale_while_revalidate"
+	SessionPolicyFailOpen             = "fail_open"
+
+	BalancingFailover   = "failover"
+	BalancingRoundRobin = "round_robin"
+
+	TLSVersion10 = "1.0"
+	TLSVersion11 = "1.1"
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+var TLSVersions = map[string]uint16{
+	TLSVersion10: tls.VersionTLS10,
+	TLSVersion11: tls.VersionTLS11,
+	TLSVersion12: tls.VersionTLS12,
+	TLSVersion13: tls.VersionTLS13,
+}
+
+var AllProviders = []string{
+	ProviderProxmox,
+	ProviderArgoCD,
+	ProviderGhost,
+	ProviderN8N,
+	ProviderNocoDB,
+}
+
+// ProviderNames are shown to users on the pages served to browsers.
+var ProviderNames = map[string]string{
+	ProviderProxmox: "Proxmox VE",
+	ProviderArgoCD:  "Argo CD",
+	ProviderGhost:   "Ghost",
+	ProviderN8N:     "n8n",
+	ProviderNocoDB:  "NocoDB",
+}
+
+func ProviderKey(provider, suffix string) string {
+	return provider + "." + suffix
+}
+
+// ServerURLs returns the server_urls of a provider, or its single server_url
+// when no list is configured.
+func ServerURLs(v *viper.Viper, provider string) []string {
+	if urls := v.GetStringSlice(ProviderKey(provider, KeySuffixServerURLs)); len(urls) > 0 {
+		return urls
+	}
+	if url := v.GetString(ProviderKey(provider, KeySuffixServerURL)); url != "" {
+		return []string{url}
+	}
+	return nil
+}
+
+func setProviderDefaults(v *viper.Viper) {
+	for _, p := range AllProviders {
+		v.SetDefault(ProviderKey(p, KeySuffixBalancing), BalancingFailover)
+		v.SetDefault(ProviderKey(p, KeySuffixHealthCheckInterval), 10*time.Second)
+		v.SetDefault(ProviderKey(p, KeySuffixSessionPolicy), SessionPolicyFailClosed)
+		v.SetDefault(ProviderKey(p, KeySuffixSessionGrace), 5*time.Minute)
+		v.SetDefault(ProviderKey(p, KeySuffixTLSMinVersion), TLSVersion12)
+		v.SetDefault(ProviderKey(p, KeySuffixTimeoutConnect), 5*time.Second)
+		v.SetDefault(ProviderKey(p, KeySuffixTimeoutRequest), 30*time.Second)
+		v.SetDefault(ProviderKey(p, KeySuffixRetryCount), 2)
+		v.SetDefault(ProviderKey(p, KeySuffixRetryWait), 100*time.Millisecond)
+		v.SetDefault(ProviderKey(p, KeySuffixRetryMaxWait), 2*time.Second)
+		v.SetDefault(ProviderKey(p, KeySuffixCircuitBreakerFailureThreshold), 5)
+		v.SetDefault(ProviderKey(p, KeySuffixCircuitBreakerOpenDuration), 30*time.Second)
+		v.SetDefault(ProviderKey(p, KeySuffixLockoutThreshold), 3)
+		v.SetDefault(ProviderKey(p, KeySuffixLockoutCooldown), time.Minute)
+		v.SetDefault(ProviderKey(p, KeySuffixLockoutMaxCooldown), time.Hour)
+		v.SetDefault(ProviderKey(p, KeySuffixLoginInterstitial), false)
+	}
+}
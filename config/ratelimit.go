@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate allows Limit requests per Period, a zero Rate is unlimited.
+type Rate struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRate parses rates written as "<limit>/<period>", e.g. "30/1m".
+func ParseRate(s string) (Rate, error) {
+	if s == "" {
+		return Rate{}, nil
+	}
+
+	limit, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("%q is not of the form <limit>/<period>", s)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("%q: limit must be a positive integer", s)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("%q: period must be a positive duration", s)
+	}
+
+	return Rate{Limit: n, Period: d}, nil
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// secrets shorter than this are not masked inside other strings, they would
+// mask unrelated text
+const minKnownSecretLength = 4
+
+var (
+	sensitiveFieldPattern = regexp.MustCompile(`(?i)password|passwd|secret|token|cookie|authorization|ticket|api[_-]?key`)
+
+	sensitiveValuePatterns = []struct {
+		re   *regexp.Regexp
+		repl string
+	}{
+		{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`), "$1 " + RedactedValue},
+		{regexp.MustCompile(`(?i)\b((?:proxy-)?authorization["']?\s*[:=]\s*)[^\s,;"]+`), "${1}" + RedactedValue},
+		{regexp.MustCompile(`(?i)\b((?:set-)?cookie["']?\s*[:=]\s*)[^\n"]+`), "${1}" + RedactedValue},
+		// Proxmox tickets, plain or URL encoded
+		{regexp.MustCompile(`\bPVE(?::|%3A)[^\s;"]+`), RedactedValue},
+	}
+
+	knownSecrets sync.Map
+)
+
+// registerSecret remembers a resolved secret so that it is masked wherever it
+// shows up in log output, e.g. inside an upstream error message.
+func registerSecret(v string) {
+	if len(v) >= minKnownSecretLength {
+		knownSecrets.Store(v, struct{}{})
+	}
+}
+
+func containsKnownSecret(p []byte) bool {
+	found := false
+	knownSecrets.Range(func(k, _ any) bool {
+		found = bytes.Contains(p, []byte(k.(string)))
+		return !found
+	})
+	return found
+}
+
+func redactString(s string) string {
+	knownSecrets.Range(func(k, _ any) bool {
+		s = strings.ReplaceAll(s, k.(string), RedactedValue)
+		return true
+	})
+	for _, p := range sensitiveValuePatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+func sensitiveField(key string) bool {
+	// file paths of secrets are fine to log
+	return sensitiveFieldPattern.MatchString(key) && !strings.HasSuffix(strings.ToLower(key), "_file")
+}
+
+func redactValue(key string, v any) any {
+	switch x := v.(type) {
+	case string:
+		if sensitiveField(key) && x != "" {
+			return RedactedValue
+		}
+		return redactString(x)
+	case map[string]any:
+		for k, child := range x {
+			x[k] = redactValue(k, child)
+		}
+		return x
+	case []any:
+		for i, child := range x {
+			x[i] = redactValue(key, child)
+		}
+		return x
+	default:
+		if sensitiveField(key) && v != nil {
+			return RedactedValue
+		}
+		return v
+	}
+}
+
+// redactWriter masks secret fields, known secret values, cookies and
+// Authorization headers in the JSON lines written by zerolog.
+type redactWriter struct {
+	next io.Writer
+}
+
+func (w redactWriter) needsRedaction(p []byte) bool {
+	if sensitiveFieldPattern.Match(p) || containsKnownSecret(p) {
+		return true
+	}
+	for _, pattern := range sensitiveValuePatterns {
+		if pattern.re.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if !w.needsRedaction(p) {
+		return w.next.Write(p)
+	}
+
+	var line map[string]any
+	d := json.NewDecoder(bytes.NewReader(p))
+	d.UseNumber()
+	if err := d.Decode(&line); err != nil {
+		if _, err := io.WriteString(w.next, redactString(string(p))); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(redactValue("", line)); err != nil {
+		return 0, err
+	}
+	if _, err := w.next.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
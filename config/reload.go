@@ -0,0 +1,142 @@
+package config
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/fx"
+)
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func(v *viper.Viper)
+)
+
+// OnReload registers fn to be called with the new configuration after every
+// successful reload, e.g. to rebuild HTTP clients.
+func OnReload(fn func(v *viper.Viper)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	reloadHooks = append(reloadHooks, fn)
+}
+
+func reload() error {
+	v := viper.New()
+	if err := configure(v); err != nil {
+		return err
+	}
+	bindPFlags(v)
+
+	if err := Validate(v); err != nil {
+		return err
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	current.Store(v)
+	setLogLevel(v)
+	for _, fn := range reloadHooks {
+		fn(v)
+	}
+
+	return nil
+}
+
+func RunConfigWatcher(lc fx.Lifecycle, mp metric.MeterProvider) error {
+	logger := log.With().Str("logger", "config").Logger()
+
+	reloads, err := mp.Meter(AppName).Int64Counter("config.reloads", metric.WithDescription("Number of configuration reloads by outcome"))
+	if err != nil {
+		return err
+	}
+
+	onChange := func(name string) {
+		if err := reload(); err != nil {
+			logger.Error().Err(err).Str("file", name).Msg("config reload failed, keeping previous config")
+			reloads.Add(context.Background(), 1, metric.WithAttributes(attribute.String("outcome", "failure")))
+			return
+		}
+		logger.Info().Str("file", name).Msg("config reloaded")
+		reloads.Add(context.Background(), 1, metric.WithAttributes(attribute.String("outcome", "success")))
+	}
+
+	file := viper.ConfigFileUsed()
+	dir := DropInDir(viper.GetViper())
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		dir = ""
+	}
+	if file == "" && dir == "" {
+		logger.Info().Msg("no config file in use, hot reload disabled")
+		return nil
+	}
+
+	var dirWatcher *fsnotify.Watcher
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			if file != "" {
+				w := viper.New()
+				w.SetConfigFile(file)
+				if err := w.ReadInConfig(); err != nil {
+					return err
+				}
+				w.OnConfigChange(func(e fsnotify.Event) {
+					onChange(e.Name)
+				})
+				w.WatchConfig()
+
+				logger.Info().Str("file", file).Msg("watching config file for changes")
+			}
+
+			if dir != "" {
+				var err error
+				if dirWatcher, err = fsnotify.NewWatcher(); err != nil {
+					return err
+				}
+				if err := dirWatcher.Add(dir); err != nil {
+					dirWatcher.Close()
+					return err
+				}
+
+				go func() {
+					for {
+						select {
+						case e, ok := <-dirWatcher.Events:
+							if !ok {
+								return
+							}
+							if e.Has(fsnotify.Chmod) {
+								continue
+							}
+							onChange(e.Name)
+						case err, ok := <-dirWatcher.Errors:
+							if !ok {
+								return
+							}
+							logger.Warn().Err(err).Msg("config directory watcher error")
+						}
+					}
+				}()
+
+				logger.Info().Str("dir", dir).Msg("watching config directory for changes")
+			}
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			if dirWatcher != nil {
+				return dirWatcher.Close()
+			}
+			return nil
+		},
+	})
+
+	return nil
+}
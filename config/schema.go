@@ -0,0 +1,230 @@
+package config
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	TypeString     = "string"
+	TypeInteger    = "integer"
+	TypeNumber     = "number"
+	TypeBoolean    = "boolean"
+	TypeDuration   = "duration"
+	TypeURL        = "url"
+	TypeFile       = "file"
+	TypeStringList = "string_list"
+	TypeStringMap  = "string_map"
+)
+
+var durationPattern = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`)
+
+type KeySpec struct {
+	Key         string
+	Type        string
+	Description string
+	Default     any
+	Enum        []string
+	// Required keys must be set whenever any other key of the same provider is.
+	Required bool
+}
+
+var flagTypes = map[string]string{
+	"string":         TypeString,
+	"int":            TypeInteger,
+	"int64":          TypeInteger,
+	"float64":        TypeNumber,
+	"bool":           TypeBoolean,
+	"duration":       TypeDuration,
+	"stringSlice":    TypeStringList,
+	"stringToString": TypeStringMap,
+}
+
+var flagEnums = map[string][]string{
+	KeyTraceExporter:     {TraceExporterOTLPGRPC, TraceExporterOTLPHTTP, TraceExporterStdout, TraceExporterNone},
+	KeyAuditSink:         {AuditSinkNone, AuditSinkStdout, AuditSinkFile, AuditSinkWebhook},
+	KeyRateLimitBackend:  {RateLimitBackendMemory, RateLimitBackendRedis},
+	KeyHTTPTLSMinVersion: {TLSVersion10, TLSVersion11, TLSVersion12, TLSVersion13},
+}
+
+// flagFiles are string flags holding a path that must exist.
+var flagFiles = []string{KeyHTTPTLSCertFile, KeyHTTPTLSKeyFile, KeyHTTPTLSClientCAFile, KeyHTTPTemplateDir}
+
+func providerKeySpecs(provider string) []KeySpec {
+	specs := []KeySpec{
+		{Key: ProviderKey(provider, KeySuffixServerURL), Type: TypeURL, Description: "Upstream server URL, required unless server_urls is set"},
+		{Key: ProviderKey(provider, KeySuffixServerURLs), Type: TypeStringList, Description: "Upstream server URLs of equivalent nodes, the first one is preferred with failover"},
+		{Key: ProviderKey(provider, KeySuffixBalancing), Type: TypeString, Description: "How requests are spread over server_urls", Default: BalancingFailover, Enum: []string{BalancingFailover, BalancingRoundRobin}},
+		{Key: ProviderKey(provider, KeySuffixHealthCheckInterval), Type: TypeDuration, Description: "Interval of the health checks of server_urls, 0 disables them", Default: (10 * time.Second).String()},
+		{Key: provider + ".username", Type: TypeString, Description: "Upstream service account username", Required: true},
+		{Key: provider + ".password", Type: TypeString, Description: "Upstream service account password"},
+		{Key: provider + ".password_file", Type: TypeString, Description: "File to read the upstream service account password from"},
+		{Key: ProviderKey(provider, KeySuffixSessionPolicy), Type: TypeString, Description: "Behaviour when the upstream cannot validate a session", Default: SessionPolicyFailClosed, Enum: []string{SessionPolicyFailClosed, SessionPolicyStaleWhileRevalidate, SessionPolicyFailOpen}},
+		{Key: ProviderKey(provider, KeySuffixSessionGrace), Type: TypeDuration, Description: "How long a session is kept past the cache TTL", Default: (5 * time.Minute).String()},
+		{Key: ProviderKey(provider, KeySuffixSessionFailOpenAllowlist), Type: TypeStringList, Description: "Subjects allowed through with fail_open while the upstream is unavailable"},
+		{Key: ProviderKey(provider, KeySuffixTimeoutConnect), Type: TypeDuration, Description: "Upstream connect and TLS handshake timeout", Default: (5 * time.Second).String()},
+		{Key: ProviderKey(provider, KeySuffixTimeoutRequest), Type: TypeDuration, Description: "Upstream request timeout of a single attempt", Default: (30 * time.Second).String()},
+		{Key: ProviderKey(provider, KeySuffixRetryCount), Type: TypeInteger, Description: "Number of retries of idempotent upstream requests", Default: 2},
+		{Key: ProviderKey(provider, KeySuffixRetryWait), Type: TypeDuration, Description: "Initial wait between retries, grows exponentially with jitter", Default: (100 * time.Millisecond).String()},
+		{Key: ProviderKey(provider, KeySuffixRetryMaxWait), Type: TypeDuration, Description: "Maximum wait between retries", Default: (2 * time.Second).String()},
+		{Key: ProviderKey(provider, KeySuffixCircuitBreakerFailureThreshold), Type: TypeInteger, Description: "Consecutive upstream failures that open the circuit breaker, 0 disables it", Default: 5},
+		{Key: ProviderKey(provider, KeySuffixCircuitBreakerOpenDuration), Type: TypeDuration, Description: "How long the circuit breaker stays open before a trial request", Default: (30 * time.Second).String()},
+		{Key: ProviderKey(provider, KeySuffixLockoutThreshold), Type: TypeInteger, Description: "Consecutive logins rejected by the upstream before logins are suspended, 0 disables it", Default: 3},
+		{Key: ProviderKey(provider, KeySuffixLockoutCooldown), Type: TypeDuration, Description: "How long logins are first suspended, doubled every time the trial login is rejected again", Default: time.Minute.String()},
+		{Key: ProviderKey(provider, KeySuffixLockoutMaxCooldown), Type: TypeDuration, Description: "Longest suspension of logins", Default: time.Hour.String()},
+		{Key: ProviderKey(provider, KeySuffixLoginInterstitial), Type: TypeBoolean, Description: "Show browsers a signing in page while the upstream login is performed", Default: false},
+		{Key: ProviderKey(provider, KeySuffixTLSCAFile), Type: TypeFile, Description: "CA bundle used to verify the upstream certificate, defaults to the system roots"},
+		{Key: ProviderKey(provider, KeySuffixTLSCertFile), Type: TypeFile, Description: "Client certificate presented to the upstream for mutual TLS"},
+		{Key: ProviderKey(provider, KeySuffixTLSKeyFile), Type: TypeFile, Description: "Private key of the client certificate"},
+		{Key: ProviderKey(provider, KeySuffixTLSServerName), Type: TypeString, Description: "Server name used for SNI and certificate verification instead of the URL host"},
+		{Key: ProviderKey(provider, KeySuffixTLSMinVersion), Type: TypeString, Description: "Minimum TLS version", Default: TLSVersion12, Enum: []string{TLSVersion10, TLSVersion11, TLSVersion12, TLSVersion13}},
+		{Key: ProviderKey(provider, KeySuffixProxyURL), Type: TypeString, Description: "Egress proxy for the upstream, http, https, socks5 or socks5h URL without credentials, defaults to the proxy environment variables"},
+		{Key: ProviderKey(provider, KeySuffixProxyUsername), Type: TypeString, Description: "Egress proxy username"},
+		{Key: ProviderKey(provider, KeySuffixProxyPassword), Type: TypeString, Description: "Egress proxy password"},
+		{Key: ProviderKey(provider, KeySuffixProxyPasswordFile), Type: TypeString, Description: "File to read the egress proxy password from"},
+		{Key: ProviderKey(provider, KeySuffixProxyNoProxy), Type: TypeStringList, Description: "Hosts, domains and CIDRs reached directly instead of through the egress proxy"},
+		{Key: ProviderKey(provider, KeySuffixTLSInsecureSkipVerify), Type: TypeBoolean, Description: "Skip upstream certificate verification, only meant for self-signed certificates", Default: false},
+	}
+	if provider == ProviderGhost {
+		specs = append(specs, KeySpec{Key: KeyGhostOriginURL, Type: TypeURL, Description: "Origin header sent to Ghost", Required: true})
+	}
+	return specs
+}
+
+func vaultKeySpecs() []KeySpec {
+	return []KeySpec{
+		{Key: KeyVaultAddress, Type: TypeURL, Description: "Vault server address, enables vault: references"},
+		{Key: KeyVaultNamespace, Type: TypeString, Description: "Vault namespace"},
+		{Key: KeyVaultCAFile, Type: TypeString, Description: "CA bundle used to verify the Vault server"},
+		{Key: KeyVaultToken, Type: TypeString, Description: "Vault token for the token auth method"},
+		{Key: KeyVaultTokenFile, Type: TypeString, Description: "File to read the Vault token from"},
+		{Key: KeyVaultAuthMethod, Type: TypeString, Description: "Vault auth method", Default: VaultAuthMethodToken, Enum: []string{VaultAuthMethodToken, VaultAuthMethodKubernetes, VaultAuthMethodAppRole}},
+		{Key: KeyVaultAuthMount, Type: TypeString, Description: "Vault auth mount path, defaults to the method name"},
+		{Key: KeyVaultAuthRole, Type: TypeString, Description: "Vault role for the kubernetes auth method"},
+		{Key: KeyVaultAuthJWTFile, Type: TypeString, Description: "Service account token file for the kubernetes auth method", Default: "/var/run/secrets/kubernetes.io/serviceaccount/token"},
+		{Key: KeyVaultAuthRoleID, Type: TypeString, Description: "Role ID for the approle auth method"},
+		{Key: KeyVaultAuthSecretID, Type: TypeString, Description: "Secret ID for the approle auth method"},
+		{Key: KeyVaultAuthSecretIDFile, Type: TypeString, Description: "File to read the approle secret ID from"},
+		{Key: KeyVaultRefreshInterval, Type: TypeDuration, Description: "Interval to re-read vault secrets to pick up rotation", Default: (5 * time.Minute).String()},
+	}
+}
+
+func flagDefault(t string, s string) any {
+	switch t {
+	case TypeInteger:
+		return cast.ToInt64(s)
+	case TypeNumber:
+		return cast.ToFloat64(s)
+	case TypeBoolean:
+		return cast.ToBool(s)
+	case TypeStringList:
+		return []string{}
+	case TypeStringMap:
+		return map[string]string{}
+	default:
+		return s
+	}
+}
+
+// KeySpecs lists every supported configuration key. Keys backed by a command
+// line flag take their type, description and default from the flag.
+func KeySpecs() []KeySpec {
+	var specs []KeySpec
+
+	for _, key := range AllKeys {
+		spec := KeySpec{Key: key, Type: TypeString}
+		if flags != nil {
+			if f := flags.Lookup(FlagReplacer.Replace(key)); f != nil {
+				if t, ok := flagTypes[f.Value.Type()]; ok {
+					spec.Type = t
+				}
+				if slices.Contains(flagFiles, key) {
+					spec.Type = TypeFile
+				}
+				spec.Description = f.Usage
+				spec.Default = flagDefault(spec.Type, f.DefValue)
+			}
+		}
+		spec.Enum = flagEnums[key]
+		specs = append(specs, spec)
+	}
+
+	specs = append(specs, vaultKeySpecs()...)
+	for _, p := range AllProviders {
+		specs = append(specs, providerKeySpecs(p)...)
+	}
+
+	slices.SortFunc(specs, func(a, b KeySpec) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return specs
+}
+
+func jsonSchemaProperty(spec KeySpec) map[string]any {
+	p := map[string]any{}
+	if spec.Description != "" {
+		p["description"] = spec.Description
+	}
+
+	switch spec.Type {
+	case TypeDuration:
+		p["type"] = "string"
+		p["pattern"] = durationPattern.String()
+	case TypeURL:
+		p["type"] = "string"
+		p["format"] = "uri"
+	case TypeFile:
+		p["type"] = "string"
+	case TypeStringList:
+		p["type"] = "array"
+		p["items"] = map[string]any{"type": "string"}
+	case TypeStringMap:
+		p["type"] = "object"
+		p["additionalProperties"] = map[string]any{"type": "string"}
+	default:
+		p["type"] = spec.Type
+	}
+
+	if spec.Default != nil {
+		p["default"] = spec.Default
+	}
+	if len(spec.Enum) > 0 {
+		p["enum"] = spec.Enum
+	}
+	return p
+}
+
+func JSONSchema() map[string]any {
+	root := map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                AppName + " configuration",
+		"type":                 "object",
+		"properties":           map[string]any{},
+		"additionalProperties": false,
+	}
+
+	for _, spec := range KeySpecs() {
+		node := root
+		path := strings.Split(spec.Key, ".")
+		for _, name := range path[:len(path)-1] {
+			props := node["properties"].(map[string]any)
+			child, ok := props[name].(map[string]any)
+			if !ok {
+				child = map[string]any{
+					"type":                 "object",
+					"properties":           map[string]any{},
+					"additionalProperties": false,
+				}
+				props[name] = child
+			}
+			node = child
+		}
+		node["properties"].(map[string]any)[path[len(path)-1]] = jsonSchemaProperty(spec)
+	}
+
+	return root
+}
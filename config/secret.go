@@ -0,0 +1,310 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+)
+
+const RedactedValue = "[REDACTED]"
+
+var ErrSecretUnavailable = errors.New("secret unavailable")
+
+var (
+	SecretFileKeys = map[string]string{
+		KeyCacheRedisPassword: KeyCacheRedisPasswordFile,
+		KeyProxmoxPassword:    KeyProxmoxPasswordFile,
+		KeyArgoCDPassword:     KeyArgoCDPasswordFile,
+		KeyGhostPassword:      KeyGhostPasswordFile,
+		KeyN8NPassword:        KeyN8NPasswordFile,
+		KeyNocoDBPassword:     KeyNocoDBPasswordFile,
+		KeyVaultToken:         KeyVaultTokenFile,
+		KeyVaultAuthSecretID:  KeyVaultAuthSecretIDFile,
+		KeyAdminToken:         KeyAdminTokenFile,
+	}
+
+	CredentialKeys = []string{
+		KeyCacheRedisPassword,
+		KeyProxmoxUsername,
+		KeyProxmoxPassword,
+		KeyArgoCDUsername,
+		KeyArgoCDPassword,
+		KeyGhostUsername,
+		KeyGhostPassword,
+		KeyN8NUsername,
+		KeyN8NPassword,
+		KeyNocoDBUsername,
+		KeyNocoDBPassword,
+		KeyAdminToken,
+	}
+
+	fileSecrets sync.Map
+)
+
+func init() {
+	for _, p := range AllProviders {
+		SecretFileKeys[ProviderKey(p, KeySuffixProxyPassword)] = ProviderKey(p, KeySuffixProxyPasswordFile)
+		CredentialKeys = append(CredentialKeys, ProviderKey(p, KeySuffixProxyUsername), ProviderKey(p, KeySuffixProxyPassword))
+	}
+}
+
+func rawSecret(key string) string {
+	if v, ok := fileSecrets.Load(key); ok {
+		return v.(string)
+	}
+	return Viper().GetString(key)
+}
+
+// Secret returns the value of a credential key, read from its file or Vault
+// reference when configured. It fails with ErrSecretUnavailable when the
+// reference cannot be resolved, rather than returning an empty password.
+func Secret(key string) (string, error) {
+	v := rawSecret(key)
+
+	ref, ok := strings.CutPrefix(v, VaultRefPrefix)
+	if ok {
+		var err error
+		if v, err = resolveVaultRef(ref); err != nil {
+			return "", fmt.Errorf("%w: %s: %w", ErrSecretUnavailable, key, err)
+		}
+	}
+
+	if _, ok := SecretFileKeys[key]; ok {
+		registerSecret(v)
+	}
+	return v, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// secretFiles returns the keys read from each secret file configured in v.
+func secretFiles(v *viper.Viper) map[string][]string {
+	files := make(map[string][]string)
+	for key, fileKey := range SecretFileKeys {
+		if path := v.GetString(fileKey); path != "" {
+			files[path] = append(files[path], key)
+		}
+	}
+	return files
+}
+
+// loadSecretFiles reads every secret file configured in v, a key whose file
+// is no longer configured falls back to its plain value. Nothing is changed
+// when a file cannot be read.
+func loadSecretFiles(v *viper.Viper) (map[string][]string, error) {
+	files := secretFiles(v)
+
+	values := make(map[string]string)
+	for path, keys := range files {
+		s, err := readSecretFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", SecretFileKeys[keys[0]], err)
+		}
+		for _, key := range keys {
+			values[key] = s
+		}
+	}
+
+	for key := range SecretFileKeys {
+		s, ok := values[key]
+		if !ok {
+			fileSecrets.Delete(key)
+			continue
+		}
+		registerSecret(s)
+		fileSecrets.Store(key, s)
+	}
+	return files, nil
+}
+
+func InitSecretFiles() error {
+	for key := range SecretFileKeys {
+		if v := viper.GetString(key); !strings.HasPrefix(v, VaultRefPrefix) {
+			registerSecret(v)
+		}
+	}
+
+	_, err := loadSecretFiles(viper.GetViper())
+	return err
+}
+
+type secretFileWatcher struct {
+	logger  zerolog.Logger
+	watcher *fsnotify.Watcher
+
+	mu    sync.Mutex
+	files map[string][]string
+	dirs  map[string]struct{}
+}
+
+// RunSecretFileWatcher reloads the secret files when they change, e.g. when
+// Kubernetes rotates a mounted Secret, and follows the *_file settings of a
+// reloaded config.
+func RunSecretFileWatcher(lc fx.Lifecycle) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	w := &secretFileWatcher{
+		logger:  log.With().Str("logger", "secret").Logger(),
+		watcher: watcher,
+		dirs:    make(map[string]struct{}),
+	}
+	if err := w.watch(secretFiles(Viper())); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	OnReload(func(v *viper.Viper) {
+		files, err := loadSecretFiles(v)
+		if err != nil {
+			w.logger.Error().Err(err).Msg("failed to load secret files, keeping previous values")
+			return
+		}
+		if err := w.watch(files); err != nil {
+			w.logger.Error().Err(err).Msg("failed to watch secret files")
+		}
+	})
+
+	done := make(chan struct{})
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				w.run()
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			err := watcher.Close()
+			<-done
+			return err
+		},
+	})
+
+	return nil
+}
+
+// watch replaces the watched files. Kubernetes rotates mounted secrets by
+// swapping a symlink in the parent directory, so the directory is watched
+// instead of the file itself.
+func (w *secretFileWatcher) watch(files map[string][]string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dirs := make(map[string]struct{})
+	for path := range files {
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	for dir := range dirs {
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch secret directory %s: %w", dir, err)
+		}
+		w.dirs[dir] = struct{}{}
+	}
+	for dir := range w.dirs {
+		if _, ok := dirs[dir]; !ok {
+			// the directory may be gone already
+			_ = w.watcher.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+
+	w.files = files
+	return nil
+}
+
+func (w *secretFileWatcher) run() {
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.reload()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Warn().Err(err).Msg("secret file watcher error")
+		}
+	}
+}
+
+func (w *secretFileWatcher) reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for path, keys := range w.files {
+		v, err := readSecretFile(path)
+		if err != nil {
+			w.logger.Warn().Err(err).Str("path", path).Msg("failed to reload secret file, keeping previous value")
+			continue
+		}
+		for _, key := range keys {
+			registerSecret(v)
+			if old, _ := fileSecrets.Swap(key, v); old != v {
+				w.logger.Info().Str("key", key).Str("path", path).Msg("secret rotated")
+			}
+		}
+	}
+}
+
+func RedactedSettings() map[string]any {
+	settings := viper.AllSettings()
+	for key := range SecretFileKeys {
+		redact(settings, strings.Split(key, "."))
+	}
+	// headers usually carry an API key
+	redact(settings, strings.Split(KeyTraceHeaders, "."))
+	redact(settings, strings.Split(KeyAuditWebhookHeaders, "."))
+	return settings
+}
+
+func redact(m map[string]any, path []string) {
+	v, ok := m[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		switch x := v.(type) {
+		case string:
+			if x == "" {
+				return
+			}
+		case map[string]string:
+			if len(x) == 0 {
+				return
+			}
+		case map[string]any:
+			if len(x) == 0 {
+				return
+			}
+		}
+		m[path[0]] = RedactedValue
+		return
+	}
+	if child, ok := v.(map[string]any); ok {
+		redact(child, path[1:])
+	}
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx/fxtest"
+)
+
+// useViper makes v the current configuration for the duration of the test.
+func useViper(t *testing.T, v *viper.Viper) {
+	t.Helper()
+
+	prev := current.Swap(v)
+	t.Cleanup(func() { current.Store(prev) })
+}
+
+func TestSecret(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("secret/data/proxmox", map[string]any{"password": "from-vault"})
+
+	v := viper.New()
+	v.Set(KeyProxmoxUsername, "admin")
+	v.Set(KeyProxmoxPassword, "vault:secret/data/proxmox#password")
+	v.Set(KeyGhostPassword, "vault:secret/data/missing#password")
+	useViper(t, v)
+
+	fileSecrets.Store(KeyN8NPassword, "from-file")
+	t.Cleanup(func() { fileSecrets.Delete(KeyN8NPassword) })
+
+	t.Run("vault not configured", func(t *testing.T) {
+		if _, err := Secret(KeyProxmoxPassword); !errors.Is(err, ErrSecretUnavailable) || !errors.Is(err, ErrVaultNotConfigured) {
+			t.Errorf("Secret() error = %v, want ErrSecretUnavailable", err)
+		}
+	})
+
+	client := newTestVaultClient(t, srv.URL, vaultConfig{})
+	if _, err := client.login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vault = client
+	t.Cleanup(func() { vault = nil })
+
+	tests := []struct {
+		key     string
+		want    string
+		wantErr error
+	}{
+		{KeyProxmoxUsername, "admin", nil},
+		{KeyProxmoxPassword, "from-vault", nil},
+		{KeyN8NPassword, "from-file", nil},
+		{KeyArgoCDPassword, "", nil},
+		{KeyGhostPassword, "", ErrSecretUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := Secret(tt.key)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Secret() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func waitForSecret(t *testing.T, key, want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := Secret(key)
+		if err == nil && got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Secret(%q) = %q, %v, want %q", key, got, err, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSecretFileWatcher(t *testing.T) {
+	first := filepath.Join(t.TempDir(), "password")
+	second := filepath.Join(t.TempDir(), "password")
+	for path, content := range map[string]string{first: "first\n", second: "second\n"} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := viper.New()
+	v.Set(KeyProxmoxPassword, "plain")
+	v.Set(KeyProxmoxPasswordFile, first)
+	useViper(t, v)
+	t.Cleanup(func() { fileSecrets.Delete(KeyProxmoxPassword) })
+
+	if _, err := loadSecretFiles(v); err != nil {
+		t.Fatal(err)
+	}
+	waitForSecret(t, KeyProxmoxPassword, "first")
+
+	lc := fxtest.NewLifecycle(t)
+	if err := RunSecretFileWatcher(lc); err != nil {
+		t.Fatal(err)
+	}
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	t.Run("rotated file", func(t *testing.T) {
+		if err := os.WriteFile(first, []byte("rotated"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		waitForSecret(t, KeyProxmoxPassword, "rotated")
+	})
+
+	reloadWith := func(v *viper.Viper) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		current.Store(v)
+		for _, fn := range reloadHooks {
+			fn(v)
+		}
+	}
+
+	t.Run("file path changed by a reload", func(t *testing.T) {
+		v2 := viper.New()
+		v2.Set(KeyProxmoxPassword, "plain")
+		v2.Set(KeyProxmoxPasswordFile, second)
+		reloadWith(v2)
+		waitForSecret(t, KeyProxmoxPassword, "second")
+
+		if err := os.WriteFile(second, []byte("second rotated"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		waitForSecret(t, KeyProxmoxPassword, "second rotated")
+
+		// the previous file is no longer followed
+		if err := os.WriteFile(first, []byte("stale"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		waitForSecret(t, KeyProxmoxPassword, "second rotated")
+	})
+
+	t.Run("file setting removed by a reload", func(t *testing.T) {
+		v3 := viper.New()
+		v3.Set(KeyProxmoxPassword, "plain")
+		reloadWith(v3)
+		waitForSecret(t, KeyProxmoxPassword, "plain")
+	})
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+func validateURL(v *viper.Viper, key string) error {
+	s := v.GetString(key)
+	if s == "" {
+		return nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: %q is not an absolute http(s) URL", key, s)
+	}
+	return nil
+}
+
+// validateDuration does not wrap the cast error, which quotes the value with
+// a unit appended, e.g. "5xns" for "5x".
+func validateDuration(v *viper.Viper, key string) error {
+	if _, err := cast.ToDurationE(v.Get(key)); err != nil {
+		return fmt.Errorf("%s: %q is not a duration, expected a number with a unit such as 500ms, 30s, 5m or 1h30m", key, fmt.Sprint(v.Get(key)))
+	}
+	return nil
+}
+
+func validateSpec(v *viper.Viper, spec KeySpec) error {
+	if !v.IsSet(spec.Key) {
+		return nil
+	}
+
+	switch spec.Type {
+	case TypeDuration:
+		return validateDuration(v, spec.Key)
+	case TypeURL:
+		return validateURL(v, spec.Key)
+	case TypeFile:
+		if path := v.GetString(spec.Key); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("%s: %w", spec.Key, err)
+			}
+		}
+	case TypeInteger:
+		if _, err := cast.ToInt64E(v.Get(spec.Key)); err != nil {
+			return fmt.Errorf("%s: %w", spec.Key, err)
+		}
+	case TypeNumber:
+		if _, err := cast.ToFloat64E(v.Get(spec.Key)); err != nil {
+			return fmt.Errorf("%s: %w", spec.Key, err)
+		}
+	case TypeBoolean:
+		if _, err := cast.ToBoolE(v.Get(spec.Key)); err != nil {
+			return fmt.Errorf("%s: %w", spec.Key, err)
+		}
+	case TypeStringMap:
+		if _, err := cast.ToStringMapStringE(v.Get(spec.Key)); err != nil {
+			return fmt.Errorf("%s: %w", spec.Key, err)
+		}
+	}
+
+	if len(spec.Enum) > 0 && !slices.Contains(spec.Enum, v.GetString(spec.Key)) {
+		return fmt.Errorf("%s: %q is not one of %s", spec.Key, v.GetString(spec.Key), strings.Join(spec.Enum, ", "))
+	}
+	return nil
+}
+
+func validateProvider(v *viper.Viper, provider string) []error {
+	specs := providerKeySpecs(provider)
+
+	configured := slices.ContainsFunc(specs, func(spec KeySpec) bool {
+		return spec.Default == nil && v.IsSet(spec.Key)
+	})
+	if !configured {
+		return nil
+	}
+
+	var errs []error
+	for _, spec := range specs {
+		if spec.Required && v.GetString(spec.Key) == "" {
+			errs = append(errs, fmt.Errorf("%s: required when %s is configured", spec.Key, provider))
+		}
+	}
+
+	urls := ServerURLs(v, provider)
+	if len(urls) == 0 {
+		errs = append(errs, fmt.Errorf("%s: required when %s is configured, or set %s", ProviderKey(provider, KeySuffixServerURL), provider, ProviderKey(provider, KeySuffixServerURLs)))
+	}
+	for i, s := range v.GetStringSlice(ProviderKey(provider, KeySuffixServerURLs)) {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s[%d]: %q is not an absolute http(s) URL", ProviderKey(provider, KeySuffixServerURLs), i, s))
+		}
+	}
+
+	if s := v.GetString(ProviderKey(provider, KeySuffixProxyURL)); s != "" {
+		u, err := url.Parse(s)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", ProviderKey(provider, KeySuffixProxyURL), err))
+		case !slices.Contains([]string{"http", "https", "socks5", "socks5h"}, u.Scheme) || u.Host == "":
+			errs = append(errs, fmt.Errorf("%s: %q is not an http, https, socks5 or socks5h URL", ProviderKey(provider, KeySuffixProxyURL), s))
+		case u.User != nil:
+			errs = append(errs, fmt.Errorf("%s: set credentials with %s and %s instead of in the URL", ProviderKey(provider, KeySuffixProxyURL), ProviderKey(provider, KeySuffixProxyUsername), ProviderKey(provider, KeySuffixProxyPassword)))
+		}
+	}
+
+	certFile, keyFile := ProviderKey(provider, KeySuffixTLSCertFile), ProviderKey(provider, KeySuffixTLSKeyFile)
+	if (v.GetString(certFile) == "") != (v.GetString(keyFile) == "") {
+		errs = append(errs, fmt.Errorf("%s and %s must be set together", certFile, keyFile))
+	}
+
+	password, passwordFile := provider+".password", provider+".password_file"
+	if v.GetString(password) == "" && v.GetString(passwordFile) == "" {
+		errs = append(errs, fmt.Errorf("%s: required when %s is configured, or set %s", password, provider, passwordFile))
+	}
+	return errs
+}
+
+func Validate(v *viper.Viper) error {
+	var errs []error
+
+	if _, err := zerolog.ParseLevel(v.GetString(KeyLogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", KeyLogLevel, err))
+	}
+
+	for _, spec := range KeySpecs() {
+		errs = append(errs, validateSpec(v, spec))
+	}
+
+	if _, err := ListenAddresses(v, KeyHTTPListen, KeyHTTPHost, KeyHTTPPort, HTTPRouteGroups, true); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ListenAddresses(v, KeyO11yListen, KeyO11yHost, KeyO11yPort, O11yRouteGroups, false); err != nil {
+		errs = append(errs, err)
+	}
+
+	if (v.GetString(KeyHTTPTLSCertFile) == "") != (v.GetString(KeyHTTPTLSKeyFile) == "") {
+		errs = append(errs, fmt.Errorf("%s and %s must be set together", KeyHTTPTLSCertFile, KeyHTTPTLSKeyFile))
+	}
+	if v.GetString(KeyHTTPTLSClientCAFile) != "" && v.GetString(KeyHTTPTLSCertFile) == "" {
+		errs = append(errs, fmt.Errorf("%s: requires %s", KeyHTTPTLSClientCAFile, KeyHTTPTLSCertFile))
+	}
+	for _, key := range []string{KeyHTTPTLSClientSubjects, KeyAdminClientSubjects} {
+		if len(v.GetStringSlice(key)) > 0 && v.GetString(KeyHTTPTLSClientCAFile) == "" {
+			errs = append(errs, fmt.Errorf("%s: requires %s", key, KeyHTTPTLSClientCAFile))
+		}
+	}
+
+	for _, key := range []string{KeyRateLimitLoginIP, KeyRateLimitLoginSubject, KeyRateLimitLoginProvider, KeyRateLimitSessionIP, KeyRateLimitSessionSubject, KeyRateLimitSessionProvider} {
+		if _, err := ParseRate(v.GetString(key)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	if v.GetString(KeyRateLimitBackend) == RateLimitBackendRedis && v.GetString(KeyCacheRedisHost) == "" {
+		errs = append(errs, fmt.Errorf("%s: %s requires %s", KeyRateLimitBackend, RateLimitBackendRedis, KeyCacheRedisHost))
+	}
+
+	switch v.GetString(KeyAuditSink) {
+	case AuditSinkFile:
+		if v.GetString(KeyAuditFilePath) == "" {
+			errs = append(errs, fmt.Errorf("%s: required when %s is %s", KeyAuditFilePath, KeyAuditSink, AuditSinkFile))
+		}
+	case AuditSinkWebhook:
+		if v.GetString(KeyAuditWebhookURL) == "" {
+			errs = append(errs, fmt.Errorf("%s: required when %s is %s", KeyAuditWebhookURL, KeyAuditSink, AuditSinkWebhook))
+		}
+		errs = append(errs, validateURL(v, KeyAuditWebhookURL))
+	}
+
+	if v.GetDuration(KeyShutdownDrainDelay) >= v.GetDuration(KeyShutdownTimeout) {
+		errs = append(errs, fmt.Errorf("%s: must be shorter than %s", KeyShutdownDrainDelay, KeyShutdownTimeout))
+	}
+
+	if ratio := v.GetFloat64(KeyTraceSampleRatio); ratio < 0 || ratio > 1 {
+		errs = append(errs, fmt.Errorf("%s: %v is not between 0 and 1", KeyTraceSampleRatio, ratio))
+	}
+
+	for _, fileKey := range SecretFileKeys {
+		if path := v.GetString(fileKey); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", fileKey, err))
+			}
+		}
+	}
+
+	for _, p := range AllProviders {
+		errs = append(errs, validateProvider(v, p)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+func UnknownKeys(v *viper.Viper) []string {
+	known := make(map[string]struct{})
+	for _, spec := range KeySpecs() {
+		known[spec.Key] = struct{}{}
+	}
+
+	var unknown []string
+	for _, key := range v.AllKeys() {
+		if _, ok := known[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+
+	slices.Sort(unknown)
+	return unknown
+}
@@ -0,0 +1,428 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+	"go.uber.org/fx"
+)
+
+const (
+	VaultRefPrefix = "vault:"
+
+	VaultAuthMethodToken      = "token"
+	VaultAuthMethodKubernetes = "kubernetes"
+	VaultAuthMethodAppRole    = "approle"
+
+	vaultRequestTimeout = 10 * time.Second
+	vaultRetryInterval  = 10 * time.Second
+)
+
+var (
+	ErrVaultNotConfigured = errors.New("vault reference used but vault.address is not configured")
+
+	vault *vaultClient
+)
+
+type vaultConfig struct {
+	address         string
+	namespace       string
+	caFile          string
+	authMethod      string
+	authMount       string
+	authRole        string
+	authRoleID      string
+	authJWTFile     string
+	refreshInterval time.Duration
+	// read on every login so that a rotated token or secret ID file is used
+	token    func() string
+	secretID func() string
+}
+
+func newVaultConfig(v *viper.Viper) vaultConfig {
+	return vaultConfig{
+		address:         strings.TrimRight(v.GetString(KeyVaultAddress), "/"),
+		namespace:       v.GetString(KeyVaultNamespace),
+		caFile:          v.GetString(KeyVaultCAFile),
+		authMethod:      v.GetString(KeyVaultAuthMethod),
+		authMount:       v.GetString(KeyVaultAuthMount),
+		authRole:        v.GetString(KeyVaultAuthRole),
+		authRoleID:      v.GetString(KeyVaultAuthRoleID),
+		authJWTFile:     v.GetString(KeyVaultAuthJWTFile),
+		refreshInterval: v.GetDuration(KeyVaultRefreshInterval),
+		token:           func() string { return rawSecret(KeyVaultToken) },
+		secretID:        func() string { return rawSecret(KeyVaultAuthSecretID) },
+	}
+}
+
+type vaultClient struct {
+	logger zerolog.Logger
+	cfg    vaultConfig
+	client *http.Client
+
+	mu     sync.RWMutex
+	token  string
+	lease  vaultLease
+	values map[string]string
+}
+
+type vaultLease struct {
+	duration  time.Duration
+	renewable bool
+}
+
+func setVaultDefaults(v *viper.Viper) {
+	v.SetDefault(KeyVaultAuthMethod, VaultAuthMethodToken)
+	v.SetDefault(KeyVaultAuthJWTFile, "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	v.SetDefault(KeyVaultRefreshInterval, 5*time.Minute)
+}
+
+func newVaultClient(cfg vaultConfig) (*vaultClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.caFile != "" {
+		pem, err := os.ReadFile(cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", KeyVaultCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &vaultClient{
+		logger: log.With().Str("logger", "vault").Logger(),
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: vaultRequestTimeout},
+		values: make(map[string]string),
+	}, nil
+}
+
+func InitVault() error {
+	cfg := newVaultConfig(viper.GetViper())
+	if cfg.address == "" {
+		return nil
+	}
+
+	v, err := newVaultClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*vaultRequestTimeout)
+	defer cancel()
+
+	if v.lease, err = v.login(ctx); err != nil {
+		return fmt.Errorf("failed to login to vault: %w", err)
+	}
+
+	// resolve every reference up front so a typo fails the start instead of an upstream login
+	for _, key := range CredentialKeys {
+		ref, ok := strings.CutPrefix(rawSecret(key), VaultRefPrefix)
+		if !ok {
+			continue
+		}
+		if _, err := v.get(ctx, ref); err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", key, err)
+		}
+	}
+
+	vault = v
+	return nil
+}
+
+// RunVault renews the Vault token and refreshes the resolved secrets while
+// the app is running.
+func RunVault(lc fx.Lifecycle) {
+	v := vault
+	if v == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				v.maintainToken(ctx)
+			}()
+			go func() {
+				defer wg.Done()
+				v.refresh(ctx, v.cfg.refreshInterval)
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			wg.Wait()
+			return nil
+		},
+	})
+}
+
+func resolveVaultRef(ref string) (string, error) {
+	if vault == nil {
+		return "", ErrVaultNotConfigured
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultRequestTimeout)
+	defer cancel()
+
+	return vault.get(ctx, ref)
+}
+
+// do sends a request with the current token.
+func (v *vaultClient) do(ctx context.Context, method, path string, body any) (gjson.Result, error) {
+	v.mu.RLock()
+	token := v.token
+	v.mu.RUnlock()
+
+	return v.request(ctx, method, path, token, body)
+}
+
+func (v *vaultClient) request(ctx context.Context, method, path, token string, body any) (gjson.Result, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.cfg.address+"/v1/"+strings.TrimLeft(path, "/"), r)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if v.cfg.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.namespace)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return gjson.Result{}, fmt.Errorf("vault %s %s: %s %s", method, path, res.Status, gjson.GetBytes(b, "errors").String())
+	}
+
+	return gjson.ParseBytes(b), nil
+}
+
+// login obtains a new token, the current one is kept in use until then so
+// that concurrent reads are not sent without a token.
+func (v *vaultClient) login(ctx context.Context) (vaultLease, error) {
+	method := v.cfg.authMethod
+	mount := v.cfg.authMount
+	if mount == "" {
+		mount = method
+	}
+
+	var body map[string]string
+	switch method {
+	case VaultAuthMethodToken:
+		token := v.cfg.token()
+		res, err := v.request(ctx, http.MethodGet, "auth/token/lookup-self", token, nil)
+		if err != nil {
+			return vaultLease{}, err
+		}
+
+		v.mu.Lock()
+		v.token = token
+		v.mu.Unlock()
+
+		return vaultLease{
+			duration:  time.Duration(res.Get("data.ttl").Int()) * time.Second,
+			renewable: res.Get("data.renewable").Bool(),
+		}, nil
+	case VaultAuthMethodKubernetes:
+		jwt, err := readSecretFile(v.cfg.authJWTFile)
+		if err != nil {
+			return vaultLease{}, err
+		}
+		body = map[string]string{
+			"role": v.cfg.authRole,
+			"jwt":  jwt,
+		}
+	case VaultAuthMethodAppRole:
+		body = map[string]string{
+			"role_id":   v.cfg.authRoleID,
+			"secret_id": v.cfg.secretID(),
+		}
+	default:
+		return vaultLease{}, fmt.Errorf("unsupported %s %q", KeyVaultAuthMethod, method)
+	}
+
+	// login endpoints are unauthenticated, an expired token would be rejected
+	res, err := v.request(ctx, http.MethodPost, "auth/"+mount+"/login", "", body)
+	if err != nil {
+		return vaultLease{}, err
+	}
+	token := res.Get("auth.client_token").String()
+	if token == "" {
+		return vaultLease{}, errors.New("vault login returned no client token")
+	}
+
+	v.mu.Lock()
+	v.token = token
+	v.mu.Unlock()
+
+	v.logger.Info().Str("method", method).Msg("logged in to vault")
+
+	return vaultLease{
+		duration:  time.Duration(res.Get("auth.lease_duration").Int()) * time.Second,
+		renewable: res.Get("auth.renewable").Bool(),
+	}, nil
+}
+
+func (v *vaultClient) renewSelf(ctx context.Context) (vaultLease, error) {
+	res, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{})
+	if err != nil {
+		return vaultLease{}, err
+	}
+
+	return vaultLease{
+		duration:  time.Duration(res.Get("auth.lease_duration").Int()) * time.Second,
+		renewable: res.Get("auth.renewable").Bool(),
+	}, nil
+}
+
+// maintainToken renews the token, or logs in again, before its lease runs out
+// until ctx is done.
+func (v *vaultClient) maintainToken(ctx context.Context) {
+	lease := v.lease
+	for {
+		// a zero lease means the token never expires
+		if lease.duration <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lease.duration * 2 / 3):
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, vaultRequestTimeout)
+		var err error
+		if lease.renewable {
+			if lease, err = v.renewSelf(reqCtx); err == nil {
+				v.logger.Debug().Dur("lease", lease.duration).Msg("vault token renewed")
+			} else {
+				v.logger.Warn().Err(err).Msg("failed to renew vault token, logging in again")
+			}
+		}
+		if ctx.Err() == nil && (!lease.renewable || err != nil) {
+			if lease, err = v.login(reqCtx); err != nil {
+				v.logger.Error().Err(err).Msg("failed to login to vault")
+				lease = vaultLease{duration: vaultRetryInterval * 3 / 2}
+			}
+		}
+		cancel()
+	}
+}
+
+// refresh reads the resolved secrets again every interval until ctx is done,
+// so that rotated values are picked up.
+func (v *vaultClient) refresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		v.mu.RLock()
+		refs := make([]string, 0, len(v.values))
+		for ref := range v.values {
+			refs = append(refs, ref)
+		}
+		v.mu.RUnlock()
+
+		for _, ref := range refs {
+			reqCtx, cancel := context.WithTimeout(ctx, vaultRequestTimeout)
+			if _, err := v.read(reqCtx, ref); err != nil && ctx.Err() == nil {
+				v.logger.Warn().Err(err).Str("ref", ref).Msg("failed to refresh vault secret, keeping previous value")
+			}
+			cancel()
+		}
+	}
+}
+
+func (v *vaultClient) get(ctx context.Context, ref string) (string, error) {
+	v.mu.RLock()
+	s, ok := v.values[ref]
+	v.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	return v.read(ctx, ref)
+}
+
+// read fetches a KV v2 reference written as <mount>/data/<path>#<field>.
+func (v *vaultClient) read(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid vault reference %q, expected %s<path>#<field>", ref, VaultRefPrefix)
+	}
+
+	res, err := v.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	value := res.Get("data.data." + gjson.Escape(field))
+	if !value.Exists() {
+		return "", fmt.Errorf("field %q not found in vault secret %s", field, path)
+	}
+	s := value.String()
+
+	v.mu.Lock()
+	old, existed := v.values[ref]
+	v.values[ref] = s
+	v.mu.Unlock()
+
+	if existed && old != s {
+		v.logger.Info().Str("ref", ref).Str("version", res.Get("data.metadata.version").String()).Msg("vault secret rotated")
+	}
+
+	return s, nil
+}
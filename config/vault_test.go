@@ -0,0 +1,352 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeVault is a stand-in for the AppRole, token and KV v2 APIs of Vault.
+type fakeVault struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	tokens   map[string]bool
+	secrets  map[string]map[string]any
+	versions map[string]int
+	issued   int
+
+	leaseSeconds int
+	failLogin    atomic.Bool
+	failRenew    atomic.Bool
+	logins       atomic.Int32
+	renewals     atomic.Int32
+	anonymous    atomic.Int32
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	f := &fakeVault{
+		t:            t,
+		tokens:       map[string]bool{"root": true},
+		secrets:      make(map[string]map[string]any),
+		versions:     make(map[string]int),
+		leaseSeconds: 3600,
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeVault) put(path string, data map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.secrets[path] = data
+	f.versions[path]++
+}
+
+func (f *fakeVault) reply(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		f.t.Error(err)
+	}
+}
+
+func (f *fakeVault) lease(token string) map[string]any {
+	return map[string]any{"auth": map[string]any{"client_token": token, "lease_duration": f.leaseSeconds, "renewable": true}}
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	if path == "auth/approle/login" {
+		f.logins.Add(1)
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["role_id"] != "role" || body["secret_id"] != "secret" {
+			f.reply(w, http.StatusBadRequest, map[string]any{"errors": []string{"invalid role or secret ID"}})
+			return
+		}
+		if f.failLogin.Load() {
+			f.reply(w, http.StatusServiceUnavailable, map[string]any{"errors": []string{"sealed"}})
+			return
+		}
+		f.mu.Lock()
+		f.issued++
+		token := fmt.Sprintf("s.%d", f.issued)
+		f.tokens[token] = true
+		f.mu.Unlock()
+		f.reply(w, http.StatusOK, f.lease(token))
+		return
+	}
+
+	token := r.Header.Get("X-Vault-Token")
+	f.mu.Lock()
+	valid := f.tokens[token]
+	f.mu.Unlock()
+	if !valid {
+		if token == "" {
+			f.anonymous.Add(1)
+		}
+		f.reply(w, http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case path == "auth/token/lookup-self":
+		f.reply(w, http.StatusOK, map[string]any{"data": map[string]any{"ttl": 0, "renewable": false}})
+	case path == "auth/token/renew-self":
+		f.renewals.Add(1)
+		if f.failRenew.Load() {
+			f.reply(w, http.StatusBadRequest, map[string]any{"errors": []string{"token not renewable"}})
+			return
+		}
+		f.reply(w, http.StatusOK, f.lease(token))
+	case r.Method == http.MethodGet:
+		f.mu.Lock()
+		data, ok := f.secrets[path]
+		version := f.versions[path]
+		f.mu.Unlock()
+		if !ok {
+			f.reply(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+			return
+		}
+		f.reply(w, http.StatusOK, map[string]any{"data": map[string]any{"data": data, "metadata": map[string]any{"version": version}}})
+	default:
+		f.reply(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+	}
+}
+
+func newTestVaultClient(t *testing.T, address string, cfg vaultConfig) *vaultClient {
+	t.Helper()
+
+	cfg.address = address
+	if cfg.authMethod == "" {
+		cfg.authMethod = VaultAuthMethodAppRole
+		cfg.authRoleID = "role"
+	}
+	if cfg.secretID == nil {
+		cfg.secretID = func() string { return "secret" }
+	}
+	if cfg.token == nil {
+		cfg.token = func() string { return "" }
+	}
+
+	v, err := newVaultClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVaultAppRoleLoginAndRead(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("secret/data/proxmox", map[string]any{"password": "hunter22", "user.name": "admin"})
+	v := newTestVaultClient(t, srv.URL, vaultConfig{})
+	ctx := context.Background()
+
+	lease, err := v.login(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.duration != time.Hour || !lease.renewable {
+		t.Errorf("lease = %+v, want an hour, renewable", lease)
+	}
+
+	for ref, want := range map[string]string{
+		"secret/data/proxmox#password":  "hunter22",
+		"secret/data/proxmox#user.name": "admin",
+	} {
+		got, err := v.get(ctx, ref)
+		if err != nil || got != want {
+			t.Errorf("get(%q) = %q, %v, want %q", ref, got, err, want)
+		}
+	}
+
+	// cached values survive the secret being deleted
+	f.mu.Lock()
+	delete(f.secrets, "secret/data/proxmox")
+	f.mu.Unlock()
+	if got, err := v.get(ctx, "secret/data/proxmox#password"); err != nil || got != "hunter22" {
+		t.Errorf("cached get = %q, %v", got, err)
+	}
+}
+
+func TestVaultTokenLogin(t *testing.T) {
+	_, srv := newFakeVault(t)
+	token := "root"
+	v := newTestVaultClient(t, srv.URL, vaultConfig{
+		authMethod: VaultAuthMethodToken,
+		token:      func() string { return token },
+	})
+
+	lease, err := v.login(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.duration != 0 {
+		t.Errorf("lease = %+v, want one that never expires", lease)
+	}
+
+	token = "revoked"
+	if _, err := v.login(context.Background()); err == nil {
+		t.Error("login with an invalid token succeeded")
+	}
+	if v.token != "root" {
+		t.Errorf("token = %q, want the previous token kept", v.token)
+	}
+}
+
+func TestVaultReadErrors(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("secret/data/proxmox", map[string]any{"password": "hunter22"})
+	v := newTestVaultClient(t, srv.URL, vaultConfig{})
+	if _, err := v.login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{
+		"secret/data/proxmox#username",
+		"secret/data/missing#password",
+		"secret/data/proxmox",
+		"#password",
+	} {
+		if got, err := v.get(context.Background(), ref); err == nil {
+			t.Errorf("get(%q) = %q, want an error", ref, got)
+		}
+	}
+}
+
+func TestVaultRefreshPicksUpRotation(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("secret/data/proxmox", map[string]any{"password": "hunter22"})
+	v := newTestVaultClient(t, srv.URL, vaultConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := v.login(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.get(ctx, "secret/data/proxmox#password"); err != nil {
+		t.Fatal(err)
+	}
+	f.put("secret/data/proxmox", map[string]any{"password": "rotated"})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v.refresh(ctx, 10*time.Millisecond)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if got, _ := v.get(ctx, "secret/data/proxmox#password"); got == "rotated" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rotated secret was not picked up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh did not stop")
+	}
+}
+
+func TestVaultMaintainToken(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.leaseSeconds = 0
+	v := newTestVaultClient(t, srv.URL, vaultConfig{})
+	if _, err := v.login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("renews", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		v.lease = vaultLease{duration: 15 * time.Millisecond, renewable: true}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			v.maintainToken(ctx)
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		<-done
+		if f.renewals.Load() == 0 {
+			t.Error("token was not renewed")
+		}
+	})
+
+	t.Run("logs in again when the renewal fails", func(t *testing.T) {
+		f.failRenew.Store(true)
+		logins := f.logins.Load()
+		before := v.token
+
+		ctx, cancel := context.WithCancel(context.Background())
+		v.lease = vaultLease{duration: 15 * time.Millisecond, renewable: true}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			v.maintainToken(ctx)
+		}()
+
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("maintainToken did not stop")
+		}
+		if f.logins.Load() == logins || v.token == before {
+			t.Error("did not log in again")
+		}
+	})
+}
+
+func TestVaultFailedLoginKeepsToken(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("secret/data/proxmox", map[string]any{"password": "hunter22"})
+	v := newTestVaultClient(t, srv.URL, vaultConfig{})
+	ctx := context.Background()
+	if _, err := v.login(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failLogin.Store(true)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := v.login(ctx); err == nil {
+				t.Error("login succeeded while vault is sealed")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := v.read(ctx, "secret/data/proxmox#password"); err != nil {
+				t.Errorf("read during a failed login: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if f.anonymous.Load() != 0 {
+		t.Errorf("%d requests were sent without a token", f.anonymous.Load())
+	}
+	if v.token != "s.1" {
+		t.Errorf("token = %q, want the first one kept", v.token)
+	}
+}
@@ -2,23 +2,110 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 
 	"github.com/spf13/viper"
 )
 
-func InitViper() error {
-	viper.SetConfigName(FileName)
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("./config")
-	viper.AddConfigPath("/etc/" + AppName)
-	if err := viper.ReadInConfig(); err != nil {
+const DropInDirName = "conf.d"
+
+var (
+	configPaths = []string{".", "./config", "/etc/" + AppName}
+
+	current atomic.Pointer[viper.Viper]
+)
+
+func Viper() *viper.Viper {
+	if v := current.Load(); v != nil {
+		return v
+	}
+	return viper.GetViper()
+}
+
+// DropInDir returns the conf.d directory next to the config file in use, or
+// the first one found in the config search paths when there is no config file.
+func DropInDir(v *viper.Viper) string {
+	if file := v.ConfigFileUsed(); file != "" {
+		return filepath.Join(filepath.Dir(file), DropInDirName)
+	}
+	for _, p := range configPaths {
+		dir := filepath.Join(p, DropInDirName)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+func DropInFiles(v *viper.Viper) ([]string, error) {
+	dir := DropInDir(v)
+	if dir == "" {
+		return nil, nil
+	}
+
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// mergeDropInFiles merges conf.d files in lexical order on top of the config
+// file, so a later file overrides an earlier one. Environment variables and
+// flags still take precedence over every file.
+func mergeDropInFiles(v *viper.Viper) error {
+	files, err := DropInFiles(v)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		// each file is read by its own viper, so that the type of the main
+		// config file, which may be JSON or TOML, is left alone
+		sub := viper.New()
+		sub.SetConfigFile(file)
+		sub.SetConfigType("yaml")
+		if err := sub.ReadInConfig(); err != nil {
+			return fmt.Errorf("fatal error config file %s: %w", file, err)
+		}
+		if err := v.MergeConfigMap(sub.AllSettings()); err != nil {
+			return fmt.Errorf("fatal error config file %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func configure(v *viper.Viper) error {
+	v.SetConfigName(FileName)
+	for _, p := range configPaths {
+		v.AddConfigPath(p)
+	}
+	if err := v.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			return fmt.Errorf("fatal error config file: %w", err)
 		}
 	}
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
-	viper.AutomaticEnv()
+	if err := mergeDropInFiles(v); err != nil {
+		return err
+	}
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	v.AutomaticEnv()
+
+	setProviderDefaults(v)
+	setVaultDefaults(v)
 
 	return nil
 }
+
+func InitViper() error {
+	return configure(viper.GetViper())
+}
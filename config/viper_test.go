@@ -0,0 +1,120 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigureMergesDropIns(t *testing.T) {
+	mains := map[string]string{
+		"yaml": "cache:\n  ttl: 1m\ngin:\n  mode: release\n",
+		"json": `{"cache": {"ttl": "1m"}, "gin": {"mode": "release"}}`,
+		"toml": "[cache]\nttl = \"1m\"\n\n[gin]\nmode = \"release\"\n",
+	}
+	dropIns := map[string]string{
+		"10-cache.yaml": "cache:\n  ttl: 5m\n",
+		"20-http.yml":   "http:\n  port: 9090\n",
+		"30-cache.yaml": "cache:\n  ttl: 10m\n",
+	}
+
+	for ext, main := range mains {
+		t.Run(ext, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, FileName+"."+ext), []byte(main), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(filepath.Join(dir, DropInDirName), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range dropIns {
+				if err := os.WriteFile(filepath.Join(dir, DropInDirName, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			prev := configPaths
+			configPaths = []string{dir}
+			t.Cleanup(func() { configPaths = prev })
+
+			v := viper.New()
+			if err := configure(v); err != nil {
+				t.Fatal(err)
+			}
+
+			for key, want := range map[string]string{
+				KeyCacheTTL: "10m",
+				KeyGinMode:  "release",
+				KeyHTTPPort: "9090",
+			} {
+				if got := v.GetString(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+
+			// the main config file is still read with its own type on a reload
+			if err := v.ReadInConfig(); err != nil {
+				t.Errorf("reading the %s config file again: %v", ext, err)
+			}
+		})
+	}
+}
+
+func TestConfigureRejectsInvalidDropIn(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, DropInDirName), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, DropInDirName, "broken.yaml"), []byte("cache: [ttl"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := configPaths
+	configPaths = []string{dir}
+	t.Cleanup(func() { configPaths = prev })
+
+	if err := configure(viper.New()); err == nil {
+		t.Error("configure() accepted an invalid drop-in file")
+	}
+}
+
+func TestConfigureReportsUnknownKeysOfDropIns(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, DropInDirName), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		FileName + ".yaml":                            "argo_cd:\n  server_url: https://argocd.example.com\n",
+		filepath.Join(DropInDirName, "10-argo.yaml"):  "argo_cd:\n  server_ulr: https://argocd.example.com\n  timeout:\n    request: 7s\n",
+		filepath.Join(DropInDirName, "20-cache.yaml"): "cache:\n  tll: 1m\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prev := configPaths
+	configPaths = []string{dir}
+	t.Cleanup(func() { configPaths = prev })
+
+	v := viper.New()
+	if err := configure(v); err != nil {
+		t.Fatal(err)
+	}
+
+	// the drop-in is merged into the section of the main file
+	if got := v.GetString(ProviderKey(ProviderArgoCD, KeySuffixServerURL)); got != "https://argocd.example.com" {
+		t.Errorf("argo_cd.server_url = %q, want the main file's", got)
+	}
+	if got := v.GetDuration(ProviderKey(ProviderArgoCD, KeySuffixTimeoutRequest)); got != 7*time.Second {
+		t.Errorf("argo_cd.timeout.request = %s, want the drop-in's", got)
+	}
+	if got, want := UnknownKeys(v), []string{"argo_cd.server_ulr", "cache.tll"}; !slices.Equal(got, want) {
+		t.Errorf("UnknownKeys() = %v, want the typos of the drop-ins %v", got, want)
+	}
+}
@@ -9,14 +9,20 @@ import (
 	"github.com/spf13/viper"
 )
 
-func InitZerolog() {
-	l, _ := zerolog.ParseLevel(viper.GetString(KeyLogLevel))
+func setLogLevel(v *viper.Viper) {
+	l, _ := zerolog.ParseLevel(v.GetString(KeyLogLevel))
 	if l == zerolog.NoLevel {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	} else {
 		zerolog.SetGlobalLevel(l)
 	}
+}
+
+func InitZerolog() {
+	setLogLevel(viper.GetViper())
 	if viper.GetString(KeyLogFormat) != "json" {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, NoColor: !viper.GetBool(KeyLogColor)})
+		log.Logger = log.Output(redactWriter{next: zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, NoColor: !viper.GetBool(KeyLogColor)}})
+	} else {
+		log.Logger = log.Output(redactWriter{next: os.Stderr})
 	}
 }
@@ -14,7 +14,9 @@ import (
 
 	"github.com/wei840222/ory-oathkeeper-login/config"
 	"github.com/wei840222/ory-oathkeeper-login/server"
+	"github.com/wei840222/ory-oathkeeper-login/server/audit"
 	"github.com/wei840222/ory-oathkeeper-login/server/handler"
+	"github.com/wei840222/ory-oathkeeper-login/server/upstream"
 )
 
 var rootCmd = &cobra.Command{
@@ -31,7 +33,14 @@ var rootCmd = &cobra.Command{
 		config.InitCobraPFlag(cmd)
 		config.InitZerolog()
 
-		logger.Debug().Any("config", viper.AllSettings()).Msg("config loaded")
+		if err := config.InitSecretFiles(); err != nil {
+			return err
+		}
+		if err := config.InitVault(); err != nil {
+			return err
+		}
+
+		logger.Debug().Any("config", config.RedactedSettings()).Msg("config loaded")
 
 		return nil
 	},
@@ -39,15 +48,32 @@ var rootCmd = &cobra.Command{
 		app := fx.New(
 			fx.Provide(
 				NewCache,
+				NewRateLimiter,
 				server.NewMeterProvider,
 				server.NewTracerProvider,
+				// the engine starts the HTTP server, handlers take it as their last
+				// parameter so that it is built after, and stopped before, the cache
+				// and the other dependencies of the handlers
 				server.NewGinEngine,
+				server.NewHealth,
+				server.NewServerTLS,
+				server.NewAdmin,
+				audit.NewAuditor,
+				upstream.NewRegistry,
 			),
+			// invoked in order, and stopped in reverse: the observability
+			// server outlives the HTTP server, which stops after the drain
 			fx.Invoke(
+				config.RunSecretFileWatcher,
+				config.RunVault,
+				config.RunConfigWatcher,
+				server.RunTemplateWatcher,
+				server.RunO11yHTTPServer,
 				handler.RegisterLoginHandler,
 				handler.RegisterSessionHandler,
-				server.RunO11yHTTPServer,
+				server.RegisterDrain,
 			),
+			fx.StopTimeout(viper.GetDuration(config.KeyShutdownTimeout)),
 			fx.WithLogger(fxlogger.WithZerolog(log.Logger)),
 		)
 
@@ -62,18 +88,78 @@ func main() {
 
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyO11yHost), "0.0.0.0", "Observability server host")
 	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyO11yPort), 9090, "Observability server port")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyO11yListen), nil, "Observability server listeners, e.g. tcp://0.0.0.0:9090 or unix:///run/o11y.sock?route=metrics, defaults to host and port")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyO11yProbeInterval), 15*time.Second, "Interval of the upstream probes reported by /status")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyO11yProbeTimeout), 5*time.Second, "Timeout of an upstream probe")
+
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyTraceExporter), config.TraceExporterOTLPGRPC, "Trace exporter, otlp_grpc, otlp_http, stdout or none")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyTraceEndpoint), "", "Trace OTLP endpoint, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyTraceInsecure), false, "Trace OTLP endpoint without TLS")
+	rootCmd.PersistentFlags().StringToString(config.FlagReplacer.Replace(config.KeyTraceHeaders), nil, "Trace OTLP headers, e.g. authorization=Bearer ...")
+	rootCmd.PersistentFlags().Float64(config.FlagReplacer.Replace(config.KeyTraceSampleRatio), 1, "Trace sample ratio of root spans, child spans follow the parent's decision")
+
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyRateLimitBackend), config.RateLimitBackendMemory, "Rate limit backend, memory or redis to share limits between replicas")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyRateLimitLoginIP), "30/1m", "Rate limit of logins per client IP, e.g. 30/1m, empty disables it")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyRateLimitLoginSubject), "30/1m", "Rate limit of logins per Ory subject")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyRateLimitLoginProvider), "300/1m", "Rate limit of logins per provider")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyRateLimitSessionIP), "", "Rate limit of session checks per client IP")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyRateLimitSessionSubject), "", "Rate limit of session checks per Ory subject")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyRateLimitSessionProvider), "", "Rate limit of session checks per provider")
+
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyAuditSink), config.AuditSinkNone, "Audit log sink, none, stdout, file or webhook")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyAuditIncludeCacheHits), false, "Audit log session checks answered from the cache")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyAuditBufferSize), 1024, "Audit log events buffered before new ones are dropped")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyAuditFilePath), "", "Audit log file path")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyAuditFileMaxSize), 100, "Audit log file size in megabytes before it is rotated")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyAuditFileMaxBackups), 10, "Audit log rotated files to keep, 0 keeps all")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyAuditFileMaxAge), 30*24*time.Hour, "Audit log rotated files age before removal, 0 keeps all")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyAuditFileCompress), false, "Audit log rotated files gzip compression")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyAuditWebhookURL), "", "Audit log webhook URL")
+	rootCmd.PersistentFlags().StringToString(config.FlagReplacer.Replace(config.KeyAuditWebhookHeaders), nil, "Audit log webhook headers, e.g. authorization=Bearer ...")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyAuditWebhookBatchSize), 100, "Audit log webhook maximum events per request")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyAuditWebhookFlushInterval), 5*time.Second, "Audit log webhook interval to send a partial batch")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyAuditWebhookRetryCount), 3, "Audit log webhook retries of a failed batch")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyAuditWebhookTimeout), 10*time.Second, "Audit log webhook request timeout")
+
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyAdminToken), "", "Admin API bearer token, the admin API is disabled without a token or client subjects")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyAdminTokenFile), "", "Admin API bearer token file")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyAdminClientSubjects), nil, "Admin API client certificate names allowed on observability listeners serving TLS")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyAdminRevocationTTL), 24*time.Hour, "How long a revoked session or a reset of the upstream sessions is kept, should outlive the upstream sessions")
+
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyShutdownDrainDelay), 5*time.Second, "Time the service reports not ready before its HTTP servers stop on shutdown")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyShutdownTimeout), 30*time.Second, "Time allowed for the whole shutdown, including the drain delay and in-flight requests")
 
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyGinMode), "debug", "Gin mode")
 
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPHost), "0.0.0.0", "HTTP server host")
 	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyHTTPPort), 8080, "HTTP server port")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyHTTPListen), nil, "HTTP server listeners, e.g. tcp://0.0.0.0:8080?route=login, unix:///run/login.sock?mode=0660&route=session or systemd://http, defaults to host and port")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeySubjectHeader), "X-User", "HTTP request header carrying the Ory identity")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSCertFile), "", "HTTP server TLS certificate file, serves plain HTTP when empty")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSKeyFile), "", "HTTP server TLS private key file")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSMinVersion), config.TLSVersion12, "HTTP server minimum TLS version")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSClientCAFile), "", "HTTP server CA file verifying client certificates, which are then required on /session")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyHTTPTLSClientSubjects), nil, "Client certificate common names, DNS names, URIs or emails allowed on /session, any verified certificate when empty")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyHTTPTrustedProxies), nil, "HTTP proxies trusted to set X-Forwarded-For and the subject header, IPs or CIDRs, no proxy is trusted when empty")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTemplateDir), "", "Directory of HTML templates overriding the built-in pages shown to browsers, e.g. error.html")
 
 	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyCacheTTL), 15*time.Minute, "Cache TTL")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyCacheRedisHost), "", "Cache Redis host")
 	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyCacheRedisPort), 6379, "Cache Redis port")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyCacheRedisPassword), "", "Cache Redis password")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyCacheRedisPasswordFile), "", "Cache Redis password file")
 	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyCacheRedisDB), 0, "Cache Redis database")
 
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyCacheBoltPath), "", "Cache bolt database file path")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyCacheBoltSweepInterval), time.Minute, "Cache bolt expired entries sweep interval")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyCacheBoltCompactInterval), 24*time.Hour, "Cache bolt database compaction interval")
+
+	rootCmd.PersistentFlags().Int64(config.FlagReplacer.Replace(config.KeyCacheMemoryNumCounters), 100000, "In-memory cache number of keys to track frequency of")
+	rootCmd.PersistentFlags().Int64(config.FlagReplacer.Replace(config.KeyCacheMemoryMaxCost), 64<<20, "In-memory cache maximum size in bytes")
+	rootCmd.PersistentFlags().Int64(config.FlagReplacer.Replace(config.KeyCacheMemoryBufferItems), 64, "In-memory cache number of keys per Get buffer")
+	rootCmd.PersistentFlags().Float64(config.FlagReplacer.Replace(config.KeyCacheMemoryHitRatioThreshold), 0.5, "In-memory cache hit ratio below which a warning is logged")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyCacheMemoryHitRatioInterval), time.Minute, "In-memory cache hit ratio check interval")
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
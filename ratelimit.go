@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server/ratelimit"
+)
+
+func NewRateLimiter(lc fx.Lifecycle, mp metric.MeterProvider) (*ratelimit.Limiter, error) {
+	s := ratelimit.NewMemoryStore()
+
+	if viper.GetString(config.KeyRateLimitBackend) == config.RateLimitBackendRedis {
+		rueidisClient, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		lc.Append(fx.Hook{
+			OnStop: func(context.Context) error {
+				rueidisClient.Close()
+				return nil
+			},
+		})
+
+		s = ratelimit.NewRedisStore(rueidisClient)
+	}
+
+	return ratelimit.NewLimiter(s, mp)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// Admin is the admin API served under /admin on the observability server.
+// It is enabled when a bearer token or client certificate subjects are
+// configured.
+type Admin struct {
+	engine  *gin.Engine
+	enabled bool
+}
+
+func NewAdmin() *Admin {
+	gin.SetMode(viper.GetString(config.KeyGinMode))
+
+	a := &Admin{
+		engine: gin.New(),
+		enabled: viper.GetString(config.KeyAdminToken) != "" || viper.GetString(config.KeyAdminTokenFile) != "" ||
+			len(viper.GetStringSlice(config.KeyAdminClientSubjects)) > 0,
+	}
+	a.engine.ContextWithFallback = true
+	a.engine.Use(NewGinLogger(), NewGinRecovery(), a.authenticate)
+
+	return a
+}
+
+func (a *Admin) Enabled() bool {
+	return a.enabled
+}
+
+// Group returns a route group under /admin, requests are authenticated.
+func (a *Admin) Group(path string) *gin.RouterGroup {
+	return a.engine.Group("/admin" + path)
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.engine.ServeHTTP(w, r)
+}
+
+func (a *Admin) authenticate(c *gin.Context) {
+	token, err := config.Secret(config.KeyAdminToken)
+	if err != nil {
+		c.Error(err)
+	}
+	if token != "" {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+token)) == 1 {
+			return
+		}
+	}
+	if allowed := config.Viper().GetStringSlice(config.KeyAdminClientSubjects); len(allowed) > 0 && clientCertificateAllowed(c.Request, allowed) {
+		return
+	}
+
+	c.Header("WWW-Authenticate", "Bearer")
+	c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorRes{Error: ErrUnauthorized.Error()})
+}
@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+const (
+	EventLoginIssued      = "login_issued"
+	EventCookieReused     = "cookie_reused"
+	EventLoginFailed      = "login_failed"
+	EventSessionValidated = "session_validated"
+	EventSessionRejected  = "session_rejected"
+	EventLogout           = "logout"
+	EventUpstreamReset    = "upstream_sessions_reset"
+
+	outcomeWritten = "written"
+	outcomeDropped = "dropped"
+	outcomeFailed  = "failed"
+)
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"event"`
+	Provider string    `json:"provider"`
+	// Subject is the Ory identity, Account the upstream account it was mapped to.
+	Subject   string `json:"subject,omitempty"`
+	Account   string `json:"account,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+	// Result is the session check result or the login failure reason.
+	Result string `json:"result,omitempty"`
+}
+
+type Sink interface {
+	Write(ctx context.Context, events []Event) error
+	Close() error
+}
+
+type Auditor struct {
+	logger        zerolog.Logger
+	sink          Sink
+	batchSize     int
+	flushInterval time.Duration
+	events        metric.Int64Counter
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan Event
+}
+
+func NewAuditor(lc fx.Lifecycle, mp metric.MeterProvider) (*Auditor, error) {
+	a := &Auditor{
+		logger:        log.With().Str("logger", "audit").Logger(),
+		batchSize:     1,
+		flushInterval: time.Second,
+	}
+
+	var err error
+	if a.events, err = mp.Meter(config.AppName).Int64Counter("audit.events", metric.WithDescription("Number of audit events by event and outcome")); err != nil {
+		return nil, err
+	}
+
+	switch viper.GetString(config.KeyAuditSink) {
+	case config.AuditSinkStdout:
+		a.sink = newStdoutSink()
+	case config.AuditSinkFile:
+		a.sink = newFileSink()
+	case config.AuditSinkWebhook:
+		a.sink = newWebhookSink(a.logger)
+		a.batchSize = max(viper.GetInt(config.KeyAuditWebhookBatchSize), 1)
+		a.flushInterval = viper.GetDuration(config.KeyAuditWebhookFlushInterval)
+	default:
+		return a, nil
+	}
+	a.queue = make(chan Event, max(viper.GetInt(config.KeyAuditBufferSize), 1))
+
+	done := make(chan struct{})
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				a.run()
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			a.mu.Lock()
+			a.closed = true
+			close(a.queue)
+			a.mu.Unlock()
+
+			select {
+			case <-done:
+				a.logger.Info().Msg("audit events flushed")
+			case <-ctx.Done():
+				a.logger.Warn().Msg("audit events left unflushed on shutdown")
+			}
+			return a.sink.Close()
+		},
+	})
+
+	a.logger.Info().Str("sink", viper.GetString(config.KeyAuditSink)).Msg("audit log enabled")
+	return a, nil
+}
+
+// Event returns an event of the given type filled in from the request.
+func (a *Auditor) Event(c *gin.Context, typ, provider string) Event {
+	e := Event{
+		Time:      time.Now().UTC(),
+		Type:      typ,
+		Provider:  provider,
+		Subject:   c.GetHeader(config.Viper().GetString(config.KeySubjectHeader)),
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	if sc := trace.SpanContextFromContext(c); sc.HasTraceID() {
+		e.TraceID = sc.TraceID().String()
+	}
+	return e
+}
+
+func (a *Auditor) count(ctx context.Context, events []Event, outcome string) {
+	for _, e := range events {
+		a.events.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("event", e.Type),
+			attribute.String("outcome", outcome),
+		))
+	}
+}
+
+// Record queues an event for the sink without blocking, the event is dropped
+// when the queue is full.
+func (a *Auditor) Record(e Event) {
+	if a.sink == nil {
+		return
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.closed {
+		select {
+		case a.queue <- e:
+			return
+		default:
+		}
+	}
+	a.logger.Warn().Str("event", e.Type).Str("provider", e.Provider).Msg("audit event dropped")
+	a.count(context.Background(), []Event{e}, outcomeDropped)
+}
+
+func (a *Auditor) flush(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := a.sink.Write(context.Background(), batch); err != nil {
+		a.logger.Error().Err(err).Int("events", len(batch)).Msg("failed to write audit events")
+		a.count(context.Background(), batch, outcomeFailed)
+		return
+	}
+	a.count(context.Background(), batch, outcomeWritten)
+}
+
+func (a *Auditor) run() {
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, a.batchSize)
+	for {
+		select {
+		case e, ok := <-a.queue:
+			if !ok {
+				a.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= a.batchSize {
+				a.flush(batch)
+				batch = make([]Event, 0, a.batchSize)
+			}
+		case <-ticker.C:
+			a.flush(batch)
+			batch = make([]Event, 0, a.batchSize)
+		}
+	}
+}
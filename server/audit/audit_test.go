@@ -0,0 +1,199 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// newTestWebhook receives batches of events, answering the first failures
+// requests with 500.
+func newTestWebhook(t *testing.T, failures int32) (*httptest.Server, <-chan []Event, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	batches := make(chan []Event, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var events []Event
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			t.Errorf("decoding the batch: %v", err)
+		}
+		batches <- events
+	}))
+	t.Cleanup(srv.Close)
+	return srv, batches, &requests
+}
+
+// newTestAuditor builds a webhook auditor posting to url with settings.
+func newTestAuditor(t *testing.T, url string, settings map[string]any) (*Auditor, *fxtest.Lifecycle, *sdkmetric.ManualReader) {
+	t.Helper()
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyAuditSink, config.AuditSinkWebhook)
+	viper.Set(config.KeyAuditWebhookURL, url)
+	viper.Set(config.KeyAuditWebhookTimeout, time.Second)
+	viper.Set(config.KeyAuditWebhookBatchSize, 100)
+	viper.Set(config.KeyAuditWebhookFlushInterval, time.Hour)
+	viper.Set(config.KeyAuditBufferSize, 100)
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+
+	reader := sdkmetric.NewManualReader()
+	lc := fxtest.NewLifecycle(t)
+	a, err := NewAuditor(lc, sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, lc, reader
+}
+
+func receive(t *testing.T, batches <-chan []Event) []Event {
+	t.Helper()
+
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch was posted to the webhook")
+		return nil
+	}
+}
+
+// countEvents returns the audit.events counter by outcome.
+func countEvents(t *testing.T, reader *sdkmetric.ManualReader) map[string]int64 {
+	t.Helper()
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok && m.Name == "audit.events" {
+				for _, dp := range sum.DataPoints {
+					outcome, _ := dp.Attributes.Value(attribute.Key("outcome"))
+					counts[outcome.AsString()] += dp.Value
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestWebhookBatchesBySize(t *testing.T) {
+	srv, batches, _ := newTestWebhook(t, 0)
+	a, lc, _ := newTestAuditor(t, srv.URL, map[string]any{config.KeyAuditWebhookBatchSize: 2})
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	for _, typ := range []string{EventLoginIssued, EventCookieReused, EventSessionValidated, EventLogout} {
+		a.Record(Event{Type: typ, Provider: config.ProviderGhost})
+	}
+
+	for i, want := range [][]string{{EventLoginIssued, EventCookieReused}, {EventSessionValidated, EventLogout}} {
+		batch := receive(t, batches)
+		if len(batch) != 2 || batch[0].Type != want[0] || batch[1].Type != want[1] {
+			t.Errorf("batch %d = %+v, want %v", i, batch, want)
+		}
+	}
+}
+
+func TestWebhookBatchesByInterval(t *testing.T) {
+	srv, batches, _ := newTestWebhook(t, 0)
+	a, lc, _ := newTestAuditor(t, srv.URL, map[string]any{config.KeyAuditWebhookFlushInterval: 50 * time.Millisecond})
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	start := time.Now()
+	a.Record(Event{Type: EventLoginIssued, Provider: config.ProviderGhost})
+
+	if batch := receive(t, batches); len(batch) != 1 || batch[0].Type != EventLoginIssued {
+		t.Errorf("batch = %+v, want the single event", batch)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("a partial batch was posted after %s, before the flush interval", elapsed)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	srv, batches, requests := newTestWebhook(t, 1)
+	a, lc, reader := newTestAuditor(t, srv.URL, map[string]any{
+		config.KeyAuditWebhookBatchSize:  1,
+		config.KeyAuditWebhookRetryCount: 2,
+	})
+	lc.RequireStart()
+
+	a.Record(Event{Type: EventLoginFailed, Provider: config.ProviderGhost})
+
+	if batch := receive(t, batches); len(batch) != 1 {
+		t.Errorf("batch = %+v, want the single event", batch)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("webhook got %d requests, want the 500 retried once", n)
+	}
+	lc.RequireStop()
+	if counts := countEvents(t, reader); counts[outcomeWritten] != 1 || counts[outcomeFailed] != 0 {
+		t.Errorf("audit.events = %v, want 1 written", counts)
+	}
+}
+
+func TestWebhookFlushesOnStop(t *testing.T) {
+	srv, batches, _ := newTestWebhook(t, 0)
+	a, lc, _ := newTestAuditor(t, srv.URL, nil)
+	lc.RequireStart()
+
+	for range 3 {
+		a.Record(Event{Type: EventSessionRejected, Provider: config.ProviderGhost})
+	}
+	lc.RequireStop()
+
+	select {
+	case batch := <-batches:
+		if len(batch) != 3 {
+			t.Errorf("batch = %+v, want the 3 queued events", batch)
+		}
+	default:
+		t.Error("queued events were not posted before the auditor stopped")
+	}
+
+	// events after the stop are dropped rather than sent on a closed queue
+	a.Record(Event{Type: EventLogout, Provider: config.ProviderGhost})
+}
+
+func TestRecordDropsWhenTheBufferIsFull(t *testing.T) {
+	srv, batches, _ := newTestWebhook(t, 0)
+	a, lc, reader := newTestAuditor(t, srv.URL, map[string]any{config.KeyAuditBufferSize: 2})
+
+	// nothing drains the queue until the auditor starts
+	for range 5 {
+		a.Record(Event{Type: EventSessionValidated, Provider: config.ProviderGhost})
+	}
+	if counts := countEvents(t, reader); counts[outcomeDropped] != 3 {
+		t.Errorf("audit.events = %v, want 3 dropped", counts)
+	}
+
+	lc.RequireStart()
+	lc.RequireStop()
+	if batch := receive(t, batches); len(batch) != 2 {
+		t.Errorf("batch = %+v, want the 2 buffered events", batch)
+	}
+}
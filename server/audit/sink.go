@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// writerSink writes one JSON document per line.
+type writerSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func (s *writerSink) Write(_ context.Context, events []Event) error {
+	for _, e := range events {
+		if err := s.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	return s.w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func newStdoutSink() Sink {
+	return &writerSink{w: nopCloser{os.Stdout}, enc: json.NewEncoder(os.Stdout)}
+}
+
+func newFileSink() Sink {
+	w := &lumberjack.Logger{
+		Filename:   viper.GetString(config.KeyAuditFilePath),
+		MaxSize:    viper.GetInt(config.KeyAuditFileMaxSize),
+		MaxBackups: viper.GetInt(config.KeyAuditFileMaxBackups),
+		// lumberjack counts in whole days, round up so a short max age still keeps files
+		MaxAge:   int((viper.GetDuration(config.KeyAuditFileMaxAge) + 24*time.Hour - 1) / (24 * time.Hour)),
+		Compress: viper.GetBool(config.KeyAuditFileCompress),
+	}
+	return &writerSink{w: w, enc: json.NewEncoder(w)}
+}
+
+type webhookSink struct {
+	client *resty.Client
+	url    string
+}
+
+func newWebhookSink(logger zerolog.Logger) Sink {
+	client := resty.New().
+		SetLogger(webhookLogger{logger: logger}).
+		SetTimeout(viper.GetDuration(config.KeyAuditWebhookTimeout)).
+		SetHeaders(viper.GetStringMapString(config.KeyAuditWebhookHeaders)).
+		SetRetryCount(viper.GetInt(config.KeyAuditWebhookRetryCount)).
+		SetRetryWaitTime(500 * time.Millisecond).
+		SetRetryMaxWaitTime(10 * time.Second).
+		AddRetryCondition(func(res *resty.Response, err error) bool {
+			return err != nil || res.StatusCode() == http.StatusTooManyRequests || res.StatusCode() >= http.StatusInternalServerError
+		})
+
+	return &webhookSink{client: client, url: viper.GetString(config.KeyAuditWebhookURL)}
+}
+
+func (s *webhookSink) Write(ctx context.Context, events []Event) error {
+	res, err := s.client.R().SetContext(ctx).SetBody(events).Post(s.url)
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		return fmt.Errorf("audit webhook responded %s", res.Status())
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	return nil
+}
+
+type webhookLogger struct {
+	logger zerolog.Logger
+}
+
+func (l webhookLogger) Errorf(format string, v ...any) {
+	l.logger.Error().Msgf(format, v...)
+}
+
+func (l webhookLogger) Warnf(format string, v ...any) {
+	l.logger.Warn().Msgf(format, v...)
+}
+
+func (l webhookLogger) Debugf(format string, v ...any) {
+	l.logger.Debug().Msgf(format, v...)
+}
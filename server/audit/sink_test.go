@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+func TestFileSink(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	viper.Set(config.KeyAuditFilePath, path)
+	viper.Set(config.KeyAuditFileMaxSize, 1)
+
+	s := newFileSink()
+	events := []Event{
+		{Type: EventLoginIssued, Provider: config.ProviderProxmox, Subject: "alice@example.com", Account: "admin"},
+		{Type: EventLogout, Provider: config.ProviderProxmox, Account: "admin", Result: "revoked"},
+	}
+	if err := s.Write(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q is not a JSON event: %v", scanner.Text(), err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != len(events) || got[0] != events[0] || got[1] != events[1] {
+		t.Errorf("file holds %+v, want one line per event %+v", got, events)
+	}
+}
@@ -3,7 +3,17 @@ package server
 import "errors"
 
 var (
-	ErrInvalidSession = errors.New("invalid session")
+	ErrInvalidSession         = errors.New("invalid session")
+	ErrUpstreamUnavailable    = errors.New("upstream unavailable")
+	ErrRateLimited            = errors.New("rate limited")
+	ErrTemporarilyUnavailable = errors.New("temporarily unavailable")
+
+	ErrUnauthorized                = errors.New("unauthorized")
+	ErrSessionNotFound             = errors.New("session not found")
+	ErrMissingSessionFilter        = errors.New("provider, subject or account is required")
+	ErrUnknownProvider             = errors.New("unknown provider")
+	ErrClientCertificateRequired   = errors.New("client certificate required")
+	ErrClientCertificateNotAllowed = errors.New("client certificate not allowed")
 )
 
 type ErrorRes struct {
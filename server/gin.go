@@ -1,9 +1,12 @@
 package server
 
 import (
-	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/netip"
+	"runtime/debug"
 	"strings"
 	"time"
 
@@ -17,6 +20,7 @@ import (
 	"go.uber.org/fx"
 
 	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server/audit"
 )
 
 func NewGinLogger(notLogged ...string) gin.HandlerFunc {
@@ -89,37 +93,86 @@ func NewGinLogger(notLogged ...string) gin.HandlerFunc {
 	}
 }
 
-func NewGinEngine(lc fx.Lifecycle, tp trace.TracerProvider, _ metric.MeterProvider) *gin.Engine {
+// NewGinRecovery recovers from panics in handlers like gin.Recovery, but logs
+// only the method, path and panic value. The request dump of gin.Recovery
+// goes to stderr past the redacting logger and includes cookies.
+func NewGinRecovery() gin.HandlerFunc {
+	logger := log.With().Str("logger", "gin").Logger()
+
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		logger.Error().
+			Str("method", c.Request.Method).
+			Str("path", c.Request.URL.Path).
+			Interface("panic", err).
+			Str("stack", string(debug.Stack())).
+			Msg("recovered from panic")
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
+
+// TrustProxies lets only the given proxies, IPs or CIDRs, set the client IP
+// with X-Forwarded-For and the Ory subject with the http.subject_header
+// header. The subject header is removed from every other request so that
+// clients cannot choose the subject they are rate limited and audited as.
+// Requests over a Unix socket are trusted, its permissions limit who connects.
+func TrustProxies(e *gin.Engine, proxies []string) error {
+	if err := e.SetTrustedProxies(proxies); err != nil {
+		return err
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	e.Use(func(c *gin.Context) {
+		if local, ok := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+			return
+		}
+		if addr, err := netip.ParseAddr(c.RemoteIP()); err == nil {
+			for _, prefix := range prefixes {
+				if prefix.Contains(addr.Unmap()) {
+					return
+				}
+			}
+		}
+		c.Request.Header.Del(config.Viper().GetString(config.KeySubjectHeader))
+	})
+	return nil
+}
+
+// NewGinEngine takes the auditor so that it is stopped after the HTTP server
+// and records the events of in-flight requests.
+func NewGinEngine(lc fx.Lifecycle, tp trace.TracerProvider, _ metric.MeterProvider, serverTLS *ServerTLS, _ *audit.Auditor) (*gin.Engine, error) {
 	gin.SetMode(viper.GetString(config.KeyGinMode))
 
 	e := gin.New()
 	e.ContextWithFallback = true
+	// the client IP and subject are used by the rate limiter and the audit log
+	if err := TrustProxies(e, viper.GetStringSlice(config.KeyHTTPTrustedProxies)); err != nil {
+		return nil, err
+	}
 
-	e.Use(otelgin.Middleware(config.AppName, otelgin.WithTracerProvider(tp)), NewGinLogger(), gin.Recovery())
+	e.Use(otelgin.Middleware(config.AppName, otelgin.WithTracerProvider(tp)), NewGinLogger(), NewGinRecovery())
 
 	m := ginmetrics.GetMonitor()
 	m.SetSlowTime(1)
 	m.SetDuration([]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 10})
 	m.UseWithoutExposingEndpoint(e)
 
-	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", viper.GetString(config.KeyHTTPHost), viper.GetInt(config.KeyHTTPPort)),
-		Handler: e,
+	addrs, err := config.ListenAddresses(viper.GetViper(), config.KeyHTTPListen, config.KeyHTTPHost, config.KeyHTTPPort, config.HTTPRouteGroups, true)
+	if err != nil {
+		return nil, err
 	}
+	serve(lc, log.With().Str("logger", "http").Logger(), addrs, e, serverTLS.Config)
 
-	lc.Append(fx.Hook{
-		OnStart: func(context.Context) error {
-			go func() {
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					panic(err)
-				}
-			}()
-			return nil
-		},
-		OnStop: func(ctx context.Context) error {
-			return srv.Shutdown(ctx)
-		},
-	})
-
-	return e
+	return e, nil
 }
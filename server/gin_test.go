@@ -0,0 +1,46 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestGinRecoveryLogsNoRequestHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var b bytes.Buffer
+	prevLogger, prevWriter := log.Logger, gin.DefaultErrorWriter
+	log.Logger, gin.DefaultErrorWriter = zerolog.New(&b), &b
+	t.Cleanup(func() { log.Logger, gin.DefaultErrorWriter = prevLogger, prevWriter })
+
+	e := gin.New()
+	e.Use(NewGinRecovery())
+	e.GET("/login/proxmox", func(c *gin.Context) { panic("boom") })
+
+	r := httptest.NewRequest(http.MethodGet, "/login/proxmox", nil)
+	r.Header.Set("Cookie", "PVEAuthCookie=cookie-value")
+	r.Header.Set("Authorization", "Bearer token-value")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	for _, want := range []string{`"path":"/login/proxmox"`, `"panic":"boom"`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("log output does not contain %s:\n%s", want, b.String())
+		}
+	}
+	for _, secret := range []string{"cookie-value", "token-value"} {
+		if strings.Contains(b.String(), secret) {
+			t.Errorf("log output contains %q:\n%s", secret, b.String())
+		}
+	}
+}
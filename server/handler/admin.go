@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/cache"
+	"github.com/eko/gocache/lib/v4/store"
+	"github.com/gin-gonic/gin"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+	"github.com/wei840222/ory-oathkeeper-login/server/audit"
+)
+
+// SessionRes and RevokeRes name the replica that answered, sessions are
+// indexed by the replica that cached them as the cache cannot be enumerated.
+type SessionRes struct {
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Account   string    `json:"account"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Replica   string    `json:"replica"`
+}
+
+type RevokeRes struct {
+	Revoked int    `json:"revoked"`
+	Replica string `json:"replica"`
+}
+
+type ResetRes struct {
+	Provider string    `json:"provider"`
+	ResetAt  time.Time `json:"reset_at"`
+	Replica  string    `json:"replica"`
+}
+
+func upstreamResetKey(provider string) string {
+	return "upstream-reset:" + sessionKeyPrefixes[provider]
+}
+
+func cookieIssuedKey(provider, sessionKey string) string {
+	return "issued:" + sessionCacheKey(provider, sessionKey)
+}
+
+func cachedTime(ctx context.Context, c cache.CacheInterface[string], key string) (time.Time, error) {
+	s, err := c.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// upstreamSessionReset reports whether an upstream session cookie was issued
+// before the upstream sessions of its provider were last reset through the
+// admin API. Such a cookie is neither reused by a login nor accepted by a
+// session check, so that a new upstream session is created.
+func upstreamSessionReset(ctx context.Context, c cache.CacheInterface[string], provider, sessionKey string) bool {
+	resetAt, err := cachedTime(ctx, c, upstreamResetKey(provider))
+	return err == nil && issuedBefore(ctx, c, provider, sessionKey, resetAt)
+}
+
+func issuedBefore(ctx context.Context, c cache.CacheInterface[string], provider, sessionKey string, resetAt time.Time) bool {
+	issuedAt, err := cachedTime(ctx, c, cookieIssuedKey(provider, sessionKey))
+	return err != nil || issuedAt.Before(resetAt)
+}
+
+// resetCheckInterval bounds how long a replica takes to notice an upstream
+// sessions reset made through another one.
+const resetCheckInterval = 5 * time.Second
+
+type resetMarker struct {
+	resetAt   time.Time
+	checkedAt time.Time
+}
+
+// upstreamSessionReset is upstreamSessionReset for session checks, which are
+// too frequent to look up the reset of the provider in the cache every time.
+// The reset is remembered for resetCheckInterval, so that a check only costs
+// a cache round trip for the cookie's issue time while a reset is in effect.
+func (h *SessionHandler) upstreamSessionReset(ctx context.Context, provider, sessionKey string) bool {
+	marker, ok := h.resets.Load(provider)
+	if !ok || time.Since(marker.(resetMarker).checkedAt) > resetCheckInterval {
+		m := resetMarker{checkedAt: time.Now()}
+		m.resetAt, _ = cachedTime(ctx, h.cache, upstreamResetKey(provider))
+		h.resets.Store(provider, m)
+		marker = m
+	}
+
+	resetAt := marker.(resetMarker).resetAt
+	return !resetAt.IsZero() && issuedBefore(ctx, h.cache, provider, sessionKey, resetAt)
+}
+
+// cookieIssued records when a login issued an upstream session cookie. A
+// cookie issued while no reset is in effect is older than any later reset,
+// so it only has to be recorded after one.
+func cookieIssued(ctx context.Context, c cache.CacheInterface[string], provider, sessionKey string) error {
+	if _, err := c.Get(ctx, upstreamResetKey(provider)); err != nil {
+		return nil
+	}
+	return c.Set(ctx, cookieIssuedKey(provider, sessionKey), time.Now().Format(time.RFC3339Nano),
+		store.WithExpiration(config.Viper().GetDuration(config.KeyAdminRevocationTTL)))
+}
+
+// sessionID identifies a cached session without exposing its upstream token.
+func sessionID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// sessionRevoked reports whether a session was revoked through the admin API.
+func sessionRevoked(ctx context.Context, c cache.CacheInterface[string], key string) bool {
+	s, err := c.Get(ctx, key)
+	if err != nil {
+		return false
+	}
+
+	var entry cachedSession
+	return json.Unmarshal([]byte(s), &entry) == nil && entry.Revoked
+}
+
+// revoke replaces a cached session with a tombstone, so that it is rejected
+// without asking the upstream, by every replica sharing the cache, until the
+// upstream session has surely expired.
+func (h *SessionHandler) revoke(c *gin.Context, key string, s indexedSession) error {
+	b, err := json.Marshal(cachedSession{
+		Session:    OrySession{Subject: s.account},
+		ValidUntil: time.Now(),
+		Revoked:    true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := h.cache.Set(c, key, string(b), store.WithExpiration(config.Viper().GetDuration(config.KeyAdminRevocationTTL))); err != nil {
+		return err
+	}
+	h.sessions.Delete(key)
+
+	h.logger.Info().Str("provider", s.provider).Str("subject", s.subject).Str("account", s.account).Str("id", sessionID(key)).Msg("session revoked")
+	e := h.auditor.Event(c, audit.EventLogout, s.provider)
+	e.Subject = s.subject
+	e.Account = s.account
+	e.Instance = h.upstreams.ServerURL(s.provider)
+	e.Result = sessionResultRevoked
+	h.auditor.Record(e)
+	return nil
+}
+
+// matching returns the unexpired indexed sessions by cache key, filtered by
+// the provider, the Ory subject and the upstream account query parameters.
+func (h *SessionHandler) matching(c *gin.Context) map[string]indexedSession {
+	provider, subject, account := c.Query("provider"), c.Query("subject"), c.Query("account")
+
+	sessions := make(map[string]indexedSession)
+	now := time.Now()
+	h.sessions.Range(func(key, value any) bool {
+		s := value.(indexedSession)
+		if now.After(s.expiresAt) || (provider != "" && s.provider != provider) || (subject != "" && s.subject != subject) || (account != "" && s.account != account) {
+			return true
+		}
+		sessions[key.(string)] = s
+		return true
+	})
+	return sessions
+}
+
+func (h *SessionHandler) ListSessions(c *gin.Context) {
+	res := make([]SessionRes, 0)
+	for key, s := range h.matching(c) {
+		res = append(res, SessionRes{
+			ID:        sessionID(key),
+			Provider:  s.provider,
+			Subject:   s.subject,
+			Account:   s.account,
+			ExpiresAt: s.expiresAt,
+			Replica:   h.replica,
+		})
+	}
+	slices.SortFunc(res, func(a, b SessionRes) int {
+		return cmp.Or(cmp.Compare(a.Provider, b.Provider), cmp.Compare(a.Subject, b.Subject), cmp.Compare(a.Account, b.Account), a.ExpiresAt.Compare(b.ExpiresAt))
+	})
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *SessionHandler) RevokeSession(c *gin.Context) {
+	for key, s := range h.matching(c) {
+		if sessionID(key) != c.Param("id") {
+			continue
+		}
+		if err := h.revoke(c, key, s); err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, RevokeRes{Revoked: 1, Replica: h.replica})
+		return
+	}
+
+	c.JSON(http.StatusNotFound, server.ErrorRes{Error: fmt.Sprintf("%s on replica %s", server.ErrSessionNotFound, h.replica)})
+}
+
+// RevokeSessions revokes every session matching the provider, subject and
+// account filters, at least one is required.
+func (h *SessionHandler) RevokeSessions(c *gin.Context) {
+	if c.Query("provider") == "" && c.Query("subject") == "" && c.Query("account") == "" {
+		c.JSON(http.StatusBadRequest, server.ErrorRes{Error: server.ErrMissingSessionFilter.Error()})
+		return
+	}
+
+	res := RevokeRes{Replica: h.replica}
+	for key, s := range h.matching(c) {
+		if err := h.revoke(c, key, s); err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+			return
+		}
+		res.Revoked++
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// ResetUpstreamSessions makes every replica sharing the cache create new
+// upstream sessions for a provider, the cookies issued so far are no longer
+// reused or accepted.
+func (h *SessionHandler) ResetUpstreamSessions(c *gin.Context) {
+	provider := c.Param("provider")
+	if !slices.Contains(config.AllProviders, provider) {
+		c.JSON(http.StatusNotFound, server.ErrorRes{Error: fmt.Sprintf("%s: %s", server.ErrUnknownProvider, provider)})
+		return
+	}
+
+	res := ResetRes{Provider: provider, ResetAt: time.Now(), Replica: h.replica}
+	if err := h.cache.Set(c, upstreamResetKey(provider), res.ResetAt.Format(time.RFC3339Nano),
+		store.WithExpiration(config.Viper().GetDuration(config.KeyAdminRevocationTTL))); err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		return
+	}
+	// other replicas notice the reset within resetCheckInterval
+	h.resets.Store(provider, resetMarker{resetAt: res.ResetAt, checkedAt: res.ResetAt})
+
+	h.logger.Info().Str("provider", provider).Msg("upstream sessions reset")
+	e := h.auditor.Event(c, audit.EventUpstreamReset, provider)
+	e.Instance = h.upstreams.ServerURL(provider)
+	h.auditor.Record(e)
+
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/eko/gocache/lib/v4/cache"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+	"github.com/wei840222/ory-oathkeeper-login/server/audit"
+	"github.com/wei840222/ory-oathkeeper-login/server/ratelimit"
+	bolt_store "github.com/wei840222/ory-oathkeeper-login/store/bolt"
+)
+
+const testAdminToken = "admin-token"
+
+func newTestCache(t *testing.T) cache.CacheInterface[string] {
+	t.Helper()
+
+	s, err := bolt_store.NewBolt(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return cache.New[string](s)
+}
+
+// newTestSession serves the session handler and the admin API on top of the
+// login handler of newTestLogin, sharing the cache c.
+func newTestSession(t *testing.T, c cache.CacheInterface[string], settings map[string]any) (*gin.Engine, *server.Admin) {
+	t.Helper()
+
+	settings[config.KeyAdminToken] = testAdminToken
+	settings[config.KeyCacheTTL] = "1m"
+	settings[config.KeyAdminRevocationTTL] = "1h"
+	e, u := newTestLogin(t, c, settings)
+
+	lc := fxtest.NewLifecycle(t)
+	mp := noop.NewMeterProvider()
+	a, err := audit.NewAuditor(lc, mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := server.NewAdmin()
+	if err := RegisterSessionHandler(c, u, a, l, admin, mp, e); err != nil {
+		t.Fatal(err)
+	}
+	return e, admin
+}
+
+func serve(h http.Handler, method, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return serveAs(h, "", method, target, cookies...)
+}
+
+// serveAs sends the request on behalf of the Ory subject, when not empty.
+func serveAs(h http.Handler, subject, method, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	if subject != "" {
+		req.Header.Set("X-User", subject)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminSessions(t *testing.T) {
+	srv, _ := newTestUpstream(t, http.StatusOK, `{"data":{"version":"8.2"}}`)
+	e, admin := newTestSession(t, newTestCache(t), map[string]any{
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixServerURL): srv.URL,
+		config.KeyProxmoxUsername: "admin",
+		config.KeyProxmoxPassword: "hunter22",
+		config.KeySubjectHeader:   "X-User",
+	})
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticket := &http.Cookie{Name: "PVEAuthCookie", Value: "PVE%3Aadmin%40pam%3A1"}
+	if w := serveAs(e, "alice@example.com", http.MethodGet, "/session/proxmox", ticket); w.Code != http.StatusOK {
+		t.Fatalf("session check = %d: %s", w.Code, w.Body)
+	}
+
+	w := serve(admin, http.MethodGet, "/admin/sessions?provider=proxmox")
+	var sessions []SessionRes
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Subject != "alice@example.com" || sessions[0].Account != "admin" || sessions[0].Replica != hostname {
+		t.Fatalf("sessions = %+v, want alice's session on the admin account listed by %s", sessions, hostname)
+	}
+	for filter, want := range map[string]int{
+		"provider=ghost":            0,
+		"subject=alice@example.com": 1,
+		"subject=admin":             0,
+		"account=admin":             1,
+		"account=alice@example.com": 0,
+	} {
+		var filtered []SessionRes
+		if err := json.Unmarshal(serve(admin, http.MethodGet, "/admin/sessions?"+filter).Body.Bytes(), &filtered); err != nil || len(filtered) != want {
+			t.Errorf("sessions?%s = %+v, %v, want %d", filter, filtered, err, want)
+		}
+	}
+
+	if w := serve(admin, http.MethodDelete, "/admin/sessions/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("revoking an unknown session = %d", w.Code)
+	}
+
+	w = serve(admin, http.MethodDelete, "/admin/sessions/"+sessions[0].ID)
+	var res RevokeRes
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != (RevokeRes{Revoked: 1, Replica: hostname}) {
+		t.Errorf("revoke = %+v", res)
+	}
+
+	if w := serve(e, http.MethodGet, "/session/proxmox", ticket); w.Code != http.StatusUnauthorized {
+		t.Errorf("session check after revocation = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serve(admin, http.MethodGet, "/admin/sessions"); w.Body.String() != "[]" {
+		t.Errorf("sessions after revocation = %s", w.Body)
+	}
+}
+
+func TestAdminResetUpstreamSessions(t *testing.T) {
+	srv, requests := newTestUpstream(t, http.StatusOK, `{"success":1,"data":{"ticket":"PVE:admin@pam:2::new"}}`)
+	e, admin := newTestSession(t, newTestCache(t), map[string]any{
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixServerURL): srv.URL,
+		config.KeyProxmoxUsername: "admin",
+		config.KeyProxmoxPassword: "hunter22",
+	})
+
+	old := &http.Cookie{Name: "PVEAuthCookie", Value: "PVE%3Aadmin%40pam%3A1%3A%3Aold"}
+	if w := serve(e, http.MethodGet, "/session/proxmox", old); w.Code != http.StatusOK {
+		t.Fatalf("session check = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(e, http.MethodGet, "/login/proxmox", old); w.Code != http.StatusFound || w.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("login = %d with %q, want the cookie reused", w.Code, w.Header().Get("Set-Cookie"))
+	}
+
+	if w := serve(admin, http.MethodDelete, "/admin/upstream-sessions/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("resetting an unknown provider = %d", w.Code)
+	}
+	w := serve(admin, http.MethodDelete, "/admin/upstream-sessions/proxmox")
+	var res ResetRes
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Provider != config.ProviderProxmox || res.ResetAt.IsZero() {
+		t.Fatalf("reset = %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(e, http.MethodGet, "/session/proxmox", old); w.Code != http.StatusUnauthorized {
+		t.Errorf("session check with a cookie issued before the reset = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	before := requests.Load()
+	w = serve(e, http.MethodGet, "/login/proxmox", old)
+	if w.Code != http.StatusFound || requests.Load() != before+1 {
+		t.Fatalf("login = %d after %d upstream requests, want a new login only", w.Code, requests.Load()-before)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value == old.Value {
+		t.Fatalf("login set %v, want a new ticket", cookies)
+	}
+
+	issued := &http.Cookie{Name: "PVEAuthCookie", Value: cookies[0].Value}
+	if w := serve(e, http.MethodGet, "/session/proxmox", issued); w.Code != http.StatusOK {
+		t.Errorf("session check with the new ticket = %d", w.Code)
+	}
+	if w := serve(e, http.MethodGet, "/login/proxmox", issued); w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("login did not reuse the ticket issued after the reset")
+	}
+}
+
+// countingCache counts the lookups of each cache key.
+type countingCache struct {
+	cache.CacheInterface[string]
+	mu   sync.Mutex
+	gets map[string]int
+}
+
+func (c *countingCache) Get(ctx context.Context, key any) (string, error) {
+	c.mu.Lock()
+	c.gets[key.(string)]++
+	c.mu.Unlock()
+	return c.CacheInterface.Get(ctx, key)
+}
+
+func TestSessionCheckRemembersUpstreamReset(t *testing.T) {
+	srv, _ := newTestUpstream(t, http.StatusOK, `{"data":{"version":"8.2"}}`)
+	c := &countingCache{CacheInterface: newTestCache(t), gets: make(map[string]int)}
+	e, admin := newTestSession(t, c, map[string]any{
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixServerURL): srv.URL,
+		config.KeyProxmoxUsername: "admin",
+		config.KeyProxmoxPassword: "hunter22",
+	})
+
+	ticket := &http.Cookie{Name: "PVEAuthCookie", Value: "PVE%3Aadmin%40pam%3A1"}
+	for range 5 {
+		if w := serve(e, http.MethodGet, "/session/proxmox", ticket); w.Code != http.StatusOK {
+			t.Fatalf("session check = %d: %s", w.Code, w.Body)
+		}
+	}
+	if n := c.gets[upstreamResetKey(config.ProviderProxmox)]; n != 1 {
+		t.Errorf("reset marker was looked up %d times by 5 session checks, want once", n)
+	}
+
+	// a reset through this replica applies at once
+	if w := serve(admin, http.MethodDelete, "/admin/upstream-sessions/proxmox"); w.Code != http.StatusOK {
+		t.Fatalf("reset = %d: %s", w.Code, w.Body)
+	}
+	if w := serve(e, http.MethodGet, "/session/proxmox", ticket); w.Code != http.StatusUnauthorized {
+		t.Errorf("session check after the reset = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -1,254 +1,557 @@
 package handler
 
 import (
-	"context"
-	"crypto/tls"
+	"cmp"
+	"errors"
 	"fmt"
+	"html/template"
+	"math"
 	"net/http"
-	"net/http/httptrace"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/eko/gocache/lib/v4/cache"
 	"github.com/gin-gonic/gin"
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
-	"github.com/wei840222/ory-oathkeeper-login/config"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/wei840222/ory-oathkeeper-login/config"
 	"github.com/wei840222/ory-oathkeeper-login/server"
+	"github.com/wei840222/ory-oathkeeper-login/server/audit"
+	"github.com/wei840222/ory-oathkeeper-login/server/ratelimit"
+	"github.com/wei840222/ory-oathkeeper-login/server/upstream"
 )
 
+const (
+	loginResultReusedCookie = "reused_cookie"
+	loginResultSucceeded    = "succeeded"
+	loginResultFailed       = "failed"
+
+	loginFailureCircuitOpen         = "circuit_open"
+	loginFailureUpstreamUnavailable = "upstream_unavailable"
+	loginFailureUpstreamError       = "upstream_error"
+	loginFailureRejected            = "credentials_rejected"
+	loginFailureUnexpectedResponse  = "unexpected_response"
+	loginFailureLockedOut           = "locked_out"
+	loginFailureSecretUnavailable   = "secret_unavailable"
+)
+
+// unavailableRetryAfter matches the minute the users are asked to wait when
+// the upstream is unreachable.
+const unavailableRetryAfter = time.Minute
+
 type LoginHandler struct {
-	logger zerolog.Logger
-	client *resty.Client
+	logger    zerolog.Logger
+	upstreams *upstream.Registry
+	cache     cache.CacheInterface[string]
+	auditor   *audit.Auditor
+	attempts  metric.Int64Counter
+	results   metric.Int64Counter
+}
+
+var loginAuditEvents = map[string]string{
+	loginResultReusedCookie: audit.EventCookieReused,
+	loginResultSucceeded:    audit.EventLoginIssued,
+	loginResultFailed:       audit.EventLoginFailed,
+}
+
+// credentialRejections recognise the error bodies apps answer a wrong
+// username or password with besides 401 and 403.
+var credentialRejections = map[string]func(res *resty.Response) bool{
+	// the extjs API answers 200 with success 0
+	config.ProviderProxmox: func(res *resty.Response) bool {
+		success := gjson.GetBytes(res.Body(), "success")
+		return success.Exists() && !success.Bool()
+	},
+	config.ProviderGhost: func(res *resty.Response) bool {
+		switch gjson.GetBytes(res.Body(), "errors.0.type").String() {
+		case "ValidationError", "NotFoundError", "PasswordResetRequiredError":
+			return true
+		}
+		return false
+	},
+	config.ProviderNocoDB: func(res *resty.Response) bool {
+		msg := strings.ToLower(gjson.GetBytes(res.Body(), "msg").String())
+		return res.StatusCode() == http.StatusBadRequest && (strings.Contains(msg, "password") || strings.Contains(msg, "credentials"))
+	},
+}
+
+// loginFailureMessages explain a failed login to the user, without the
+// upstream response which is only logged.
+var loginFailureMessages = map[string]string{
+	loginFailureCircuitOpen:         "%s is not reachable at the moment, please try again in a minute.",
+	loginFailureUpstreamUnavailable: "%s is not reachable at the moment, please try again in a minute.",
+	loginFailureUpstreamError:       "%s answered with an error, please try again.",
+	loginFailureRejected:            "%s rejected the shared account, please contact an administrator if this persists.",
+	loginFailureUnexpectedResponse:  "%s answered unexpectedly, please contact an administrator if this persists.",
+	loginFailureSecretUnavailable:   "The credentials for %s cannot be read at the moment, please try again in a minute.",
+}
+
+// defaultReturnURLs are redirected to without a return_url, "/" otherwise.
+var defaultReturnURLs = map[string]string{
+	config.ProviderGhost: "/ghost",
+}
+
+func defaultReturnURL(provider string) string {
+	return cmp.Or(defaultReturnURLs[provider], "/")
+}
+
+func returnURL(c *gin.Context, provider string) string {
+	return c.DefaultQuery("return_url", defaultReturnURL(provider))
+}
+
+func credentialsRejected(provider string, res *resty.Response) bool {
+	switch res.StatusCode() {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return true
+	}
+	if rejected, ok := credentialRejections[provider]; ok {
+		return rejected(res)
+	}
+	return false
+}
+
+func loginFailureReason(provider string, res *resty.Response, err error) string {
+	switch {
+	case errors.Is(err, upstream.ErrCircuitOpen):
+		return loginFailureCircuitOpen
+	case err != nil:
+		return loginFailureUpstreamUnavailable
+	case credentialsRejected(provider, res):
+		return loginFailureRejected
+	case res.StatusCode() >= http.StatusInternalServerError:
+		return loginFailureUpstreamError
+	default:
+		return loginFailureUnexpectedResponse
+	}
+}
+
+func (h *LoginHandler) attempt(provider string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.attempts.Add(c, 1, metric.WithAttributes(attribute.String("provider", provider)))
+	}
+}
+
+func (h *LoginHandler) record(c *gin.Context, provider, result, reason string) {
+	attrs := []attribute.KeyValue{
+		attribute.String("provider", provider),
+		attribute.String("result", result),
+	}
+	if reason != "" {
+		attrs = append(attrs, attribute.String("reason", reason))
+	}
+	h.results.Add(c, 1, metric.WithAttributes(attrs...))
+	if result == loginResultSucceeded {
+		h.upstreams.Lockout(provider).Accepted()
+	}
+
+	span := trace.SpanFromContext(c)
+	span.SetAttributes(
+		attribute.String("provider", provider),
+		attribute.String("login.result", result),
+	)
+	if reason != "" {
+		span.SetAttributes(attribute.String("login.failure_reason", reason))
+	}
+
+	e := h.auditor.Event(c, loginAuditEvents[result], provider)
+	e.Account, _ = config.Secret(provider + ".username")
+	e.Instance = h.upstreams.ServerURL(provider)
+	e.Result = reason
+	h.auditor.Record(e)
+}
+
+// interstitial answers browsers with the signing_in.html page right away when
+// enabled for the provider, the page then repeats the request to log in, so
+// that the user does not stare at a blank page during a slow upstream login.
+func (h *LoginHandler) interstitial(provider string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.Viper().GetBool(config.ProviderKey(provider, config.KeySuffixLoginInterstitial)) ||
+			c.Query(server.InterstitialParam) != "" ||
+			c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) != gin.MIMEHTML {
+			return
+		}
+
+		q := c.Request.URL.Query()
+		q.Set(server.InterstitialParam, "skip")
+		c.Abort()
+		server.RenderPage(c, http.StatusOK, "signing_in.html", server.InterstitialPage{
+			App:         config.ProviderNames[provider],
+			ContinueURL: template.URL("?" + q.Encode()),
+			// the page navigates with a script, which must not run a javascript: URL
+			ReturnURL: template.URL(httpURL(returnURL(c, provider), defaultReturnURL(provider))),
+		})
+	}
+}
+
+// revoked reports whether an existing session was revoked, or issued before
+// the upstream sessions of the provider were reset, it is not reused so that
+// the user gets a new one instead of being sent back and forth.
+func (h *LoginHandler) revoked(c *gin.Context, provider, sessionKey string) bool {
+	return sessionRevoked(c, h.cache, sessionCacheKey(provider, sessionKey)) || upstreamSessionReset(c, h.cache, provider, sessionKey)
+}
+
+// issued records the session cookie an upstream issued, with the name the
+// session handler reads it from.
+func (h *LoginHandler) issued(c *gin.Context, provider, name string, cookies []*http.Cookie) {
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			continue
+		}
+		if err := cookieIssued(c, h.cache, provider, cookie.Value); err != nil {
+			h.logger.Warn().Err(err).Str("provider", provider).Msg("failed to record the issued session cookie")
+		}
+	}
+}
+
+// credentials returns the account to log in to a provider with. Otherwise it
+// answers the request, without asking the upstream, when the account cannot
+// be resolved, e.g. while Vault is unavailable, or when logins are suspended
+// after the upstream rejected it.
+func (h *LoginHandler) credentials(c *gin.Context, provider string) (username, password string, ok bool) {
+	username, err := config.Secret(provider + ".username")
+	if err == nil {
+		password, err = config.Secret(provider + ".password")
+	}
+	if err != nil {
+		// not the upstream's fault, so it does not count towards the lockout
+		h.record(c, provider, loginResultFailed, loginFailureSecretUnavailable)
+		c.Error(err)
+		server.AbortWithErrorPage(c, http.StatusServiceUnavailable,
+			fmt.Errorf("signing in to %s is %w", provider, server.ErrTemporarilyUnavailable),
+			server.ErrorPage{
+				App:     config.ProviderNames[provider],
+				Title:   fmt.Sprintf("Signing in to %s failed", config.ProviderNames[provider]),
+				Message: fmt.Sprintf(loginFailureMessages[loginFailureSecretUnavailable], config.ProviderNames[provider]),
+			})
+		return "", "", false
+	}
+
+	allowed, retryAfter := h.upstreams.Lockout(provider).Allow(username, password)
+	if !allowed {
+		h.record(c, provider, loginResultFailed, loginFailureLockedOut)
+		c.Error(upstream.ErrCredentialsLocked)
+		setRetryAfter(c, retryAfter)
+		server.AbortWithErrorPage(c, http.StatusServiceUnavailable,
+			fmt.Errorf("signing in to %s is %w, please try again in %s", provider, server.ErrTemporarilyUnavailable, retryAfter.Round(time.Second)),
+			server.ErrorPage{
+				App:     config.ProviderNames[provider],
+				Title:   fmt.Sprintf("Signing in to %s is paused", config.ProviderNames[provider]),
+				Message: fmt.Sprintf("%s recently rejected the shared account, please try again in %s.", config.ProviderNames[provider], retryAfter.Round(time.Second)),
+			})
+		return "", "", false
+	}
+
+	return username, password, true
+}
+
+// fail answers 503 with Retry-After when the login may succeed later without
+// anyone stepping in: the upstream is unreachable, its circuit breaker is
+// open or the rejection suspended logins. Other failures are answered 500.
+func (h *LoginHandler) fail(c *gin.Context, provider, reason string, err error) {
+	lockout := h.upstreams.Lockout(provider)
+	if reason == loginFailureRejected {
+		lockout.Rejected()
+	} else {
+		lockout.Release()
+	}
+	h.record(c, provider, loginResultFailed, reason)
+	c.Error(err)
+
+	code, retryAfter := http.StatusInternalServerError, time.Duration(0)
+	switch reason {
+	case loginFailureCircuitOpen:
+		code, retryAfter = http.StatusServiceUnavailable, h.upstreams.Breaker(provider).Remaining()
+	case loginFailureUpstreamUnavailable:
+		code, retryAfter = http.StatusServiceUnavailable, unavailableRetryAfter
+	case loginFailureRejected:
+		if remaining := lockout.Remaining(); remaining > 0 {
+			code, retryAfter = http.StatusServiceUnavailable, remaining
+		}
+	}
+	if code == http.StatusServiceUnavailable {
+		setRetryAfter(c, retryAfter)
+	}
+	server.AbortWithErrorPage(c, code, err, server.ErrorPage{
+		App:     config.ProviderNames[provider],
+		Title:   fmt.Sprintf("Signing in to %s failed", config.ProviderNames[provider]),
+		Message: fmt.Sprintf(loginFailureMessages[reason], config.ProviderNames[provider]),
+	})
+}
+
+// setRetryAfter tells the client to retry in whole seconds, at least one.
+func setRetryAfter(c *gin.Context, d time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(d.Seconds())))))
 }
 
 func (h *LoginHandler) Proxmox(c *gin.Context) {
-	if ticket, err := c.Request.Cookie("PVEAuthCookie"); err == nil {
-		h.logger.Debug().Str("cookie", ticket.Value).Msg("Using existing Proxmox cookie")
-		res, err := h.client.R().SetContext(c).
+	if ticket, err := c.Request.Cookie("PVEAuthCookie"); err == nil && !h.revoked(c, config.ProviderProxmox, ticket.Value) {
+		h.logger.Debug().Msg("Using existing Proxmox cookie")
+		res, err := h.upstreams.Client(config.ProviderProxmox).R().SetContext(c).
 			SetCookie(&http.Cookie{
 				Name:  "PVEAuthCookie",
 				Value: ticket.Value,
 			}).
-			Get(JoinURL(viper.GetString(config.KeyProxmoxServerURL), "/api2/extjs/version"))
+			Get(JoinURL(h.upstreams.ServerURL(config.ProviderProxmox), "/api2/extjs/version"))
 		if err == nil && res.IsSuccess() {
-			c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+			h.record(c, config.ProviderProxmox, loginResultReusedCookie, "")
+			c.Redirect(http.StatusFound, returnURL(c, config.ProviderProxmox))
 			return
 		}
 	}
 
-	res, err := h.client.R().SetContext(c).
+	username, password, ok := h.credentials(c, config.ProviderProxmox)
+	if !ok {
+		return
+	}
+
+	res, err := h.upstreams.Client(config.ProviderProxmox).R().SetContext(c).
 		SetFormData(map[string]string{
 			"realm":      "pam",
 			"new-format": "1",
-			"username":   viper.GetString(config.KeyProxmoxUsername),
-			"password":   viper.GetString(config.KeyProxmoxPassword),
+			"username":   username,
+			"password":   password,
 		}).
-		Post(JoinURL(viper.GetString(config.KeyProxmoxServerURL), "/api2/extjs/access/ticket"))
+		Post(JoinURL(h.upstreams.ServerURL(config.ProviderProxmox), "/api2/extjs/access/ticket"))
 	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderProxmox, loginFailureReason(config.ProviderProxmox, nil, err), err)
 		return
 	}
-	if res.IsError() {
+	if res.IsError() || credentialsRejected(config.ProviderProxmox, res) {
 		err := fmt.Errorf("failed to login to proxmox: %s %s", res.Status(), res)
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderProxmox, loginFailureReason(config.ProviderProxmox, res, nil), err)
 		return
 	}
 
-	http.SetCookie(c.Writer, &http.Cookie{
+	ticket := &http.Cookie{
 		Name:     "PVEAuthCookie",
 		Value:    strings.NewReplacer(":", "%3A", "=", "%3D").Replace(gjson.GetBytes(res.Body(), "data.ticket").String()),
 		Path:     "/",
 		Secure:   true,
 		HttpOnly: false,
 		SameSite: http.SameSiteLaxMode,
-	})
-	c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+	}
+	http.SetCookie(c.Writer, ticket)
+	h.issued(c, config.ProviderProxmox, "PVEAuthCookie", []*http.Cookie{ticket})
+	h.record(c, config.ProviderProxmox, loginResultSucceeded, "")
+	c.Redirect(http.StatusFound, returnURL(c, config.ProviderProxmox))
 }
 
 func (h *LoginHandler) ArgoCD(c *gin.Context) {
-	if token, err := c.Cookie("argocd.token"); err == nil {
-		res, err := h.client.R().SetContext(c).
+	if token, err := c.Cookie("argocd.token"); err == nil && !h.revoked(c, config.ProviderArgoCD, token) {
+		res, err := h.upstreams.Client(config.ProviderArgoCD).R().SetContext(c).
 			SetCookie(&http.Cookie{
 				Name:  "argocd.token",
 				Value: token,
 			}).
-			Get(JoinURL(viper.GetString(config.KeyArgoCDServerURL), "/api/v1/session/userinfo"))
+			Get(JoinURL(h.upstreams.ServerURL(config.ProviderArgoCD), "/api/v1/session/userinfo"))
 		if err == nil && res.IsSuccess() && gjson.GetBytes(res.Body(), "loggedIn").Bool() {
-			c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+			h.record(c, config.ProviderArgoCD, loginResultReusedCookie, "")
+			c.Redirect(http.StatusFound, returnURL(c, config.ProviderArgoCD))
 			return
 		}
 	}
 
-	res, err := h.client.R().SetContext(c).
+	username, password, ok := h.credentials(c, config.ProviderArgoCD)
+	if !ok {
+		return
+	}
+
+	res, err := h.upstreams.Client(config.ProviderArgoCD).R().SetContext(c).
 		SetBody(map[string]string{
-			"username": viper.GetString(config.KeyArgoCDUsername),
-			"password": viper.GetString(config.KeyArgoCDPassword),
+			"username": username,
+			"password": password,
 		}).
-		Post(JoinURL(viper.GetString(config.KeyArgoCDServerURL), "/api/v1/session"))
+		Post(JoinURL(h.upstreams.ServerURL(config.ProviderArgoCD), "/api/v1/session"))
 	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderArgoCD, loginFailureReason(config.ProviderArgoCD, nil, err), err)
 		return
 	}
 	if res.IsError() {
 		err := fmt.Errorf("failed to login to argo-cd: %s %s", res.Status(), res)
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderArgoCD, loginFailureReason(config.ProviderArgoCD, res, nil), err)
 		return
 	}
 
 	c.Header("Set-Cookie", res.Header().Get("Set-Cookie"))
-	c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+	h.issued(c, config.ProviderArgoCD, "argocd.token", res.Cookies())
+	h.record(c, config.ProviderArgoCD, loginResultSucceeded, "")
+	c.Redirect(http.StatusFound, returnURL(c, config.ProviderArgoCD))
 }
 
 func (h *LoginHandler) Ghost(c *gin.Context) {
-	if session, err := c.Cookie("ghost-admin-api-session"); err == nil {
-		res, err := h.client.R().SetContext(c).
+	if session, err := c.Cookie("ghost-admin-api-session"); err == nil && !h.revoked(c, config.ProviderGhost, session) {
+		res, err := h.upstreams.Client(config.ProviderGhost).R().SetContext(c).
 			SetHeaders(map[string]string{
 				"X-Forwarded-Proto": "https",
-				"Origin":            viper.GetString(config.KeyGhostOriginURL),
+				"Origin":            config.Viper().GetString(config.KeyGhostOriginURL),
 			}).
 			SetCookie(&http.Cookie{
 				Name:  "ghost-admin-api-session",
 				Value: session,
 			}).
-			Get(JoinURL(viper.GetString(config.KeyGhostServerURL), "/ghost/api/admin/users/me/"))
+			Get(JoinURL(h.upstreams.ServerURL(config.ProviderGhost), "/ghost/api/admin/users/me/"))
 		if err == nil && res.IsSuccess() {
-			c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/ghost"))
+			h.record(c, config.ProviderGhost, loginResultReusedCookie, "")
+			c.Redirect(http.StatusFound, returnURL(c, config.ProviderGhost))
 			return
 		}
 	}
 
-	res, err := h.client.R().SetContext(c).
+	username, password, ok := h.credentials(c, config.ProviderGhost)
+	if !ok {
+		return
+	}
+
+	res, err := h.upstreams.Client(config.ProviderGhost).R().SetContext(c).
 		SetHeaders(map[string]string{
 			"X-Forwarded-Proto": "https",
-			"Origin":            viper.GetString(config.KeyGhostOriginURL),
+			"Origin":            config.Viper().GetString(config.KeyGhostOriginURL),
 		}).
 		SetBody(map[string]string{
-			"username": viper.GetString(config.KeyGhostUsername),
-			"password": viper.GetString(config.KeyGhostPassword),
+			"username": username,
+			"password": password,
 		}).
-		Post(JoinURL(viper.GetString(config.KeyGhostServerURL), "/ghost/api/admin/session"))
+		Post(JoinURL(h.upstreams.ServerURL(config.ProviderGhost), "/ghost/api/admin/session"))
 	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderGhost, loginFailureReason(config.ProviderGhost, nil, err), err)
 		return
 	}
 	if res.IsError() {
 		err := fmt.Errorf("failed to login to ghost: %s %s", res.Status(), res)
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderGhost, loginFailureReason(config.ProviderGhost, res, nil), err)
 		return
 	}
 
 	c.Header("Set-Cookie", res.Header().Get("Set-Cookie"))
-	c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/ghost"))
+	h.issued(c, config.ProviderGhost, "ghost-admin-api-session", res.Cookies())
+	h.record(c, config.ProviderGhost, loginResultSucceeded, "")
+	c.Redirect(http.StatusFound, returnURL(c, config.ProviderGhost))
 }
 
 func (h *LoginHandler) N8N(c *gin.Context) {
-	if auth, err := c.Cookie("n8n-auth"); err == nil {
-		res, err := h.client.R().SetContext(c).
+	if auth, err := c.Cookie("n8n-auth"); err == nil && !h.revoked(c, config.ProviderN8N, auth) {
+		res, err := h.upstreams.Client(config.ProviderN8N).R().SetContext(c).
 			SetHeader("Browser-Id", c.GetHeader("Browser-Id")).
 			SetCookie(&http.Cookie{
 				Name:  "n8n-auth",
 				Value: auth,
 			}).
-			Get(JoinURL(viper.GetString(config.KeyN8NServerURL), "/rest/login"))
+			Get(JoinURL(h.upstreams.ServerURL(config.ProviderN8N), "/rest/login"))
 		if err == nil && res.IsSuccess() {
-			c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+			h.record(c, config.ProviderN8N, loginResultReusedCookie, "")
+			c.Redirect(http.StatusFound, returnURL(c, config.ProviderN8N))
 			return
 		}
 	}
 
-	res, err := h.client.R().SetContext(c).
+	username, password, ok := h.credentials(c, config.ProviderN8N)
+	if !ok {
+		return
+	}
+
+	res, err := h.upstreams.Client(config.ProviderN8N).R().SetContext(c).
 		SetHeader("Browser-Id", c.GetHeader("Browser-Id")).
 		SetBody(map[string]string{
-			"emailOrLdapLoginId": viper.GetString(config.KeyN8NUsername),
-			"password":           viper.GetString(config.KeyN8NPassword),
+			"emailOrLdapLoginId": username,
+			"password":           password,
 		}).
-		Post(JoinURL(viper.GetString(config.KeyN8NServerURL), "/rest/login"))
+		Post(JoinURL(h.upstreams.ServerURL(config.ProviderN8N), "/rest/login"))
 	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderN8N, loginFailureReason(config.ProviderN8N, nil, err), err)
 		return
 	}
 	if res.IsError() {
 		err := fmt.Errorf("failed to login to n8n: %s %s", res.Status(), res)
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderN8N, loginFailureReason(config.ProviderN8N, res, nil), err)
 		return
 	}
 
 	c.Header("Set-Cookie", res.Header().Get("Set-Cookie"))
-	c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+	h.issued(c, config.ProviderN8N, "n8n-auth", res.Cookies())
+	h.record(c, config.ProviderN8N, loginResultSucceeded, "")
+	c.Redirect(http.StatusFound, returnURL(c, config.ProviderN8N))
 }
 
 func (h *LoginHandler) NocoDB(c *gin.Context) {
-	if token, err := c.Cookie("refresh_token"); err == nil {
-		res, err := h.client.R().SetContext(c).
+	if token, err := c.Cookie("refresh_token"); err == nil && !h.revoked(c, config.ProviderNocoDB, token) {
+		res, err := h.upstreams.Client(config.ProviderNocoDB).R().SetContext(c).
 			SetCookie(&http.Cookie{
 				Name:  "refresh_token",
 				Value: token,
 			}).
-			Post(JoinURL(viper.GetString(config.KeyNocoDBServerURL), "/auth/token/refresh"))
+			Post(JoinURL(h.upstreams.ServerURL(config.ProviderNocoDB), "/auth/token/refresh"))
 		if err == nil && res.IsSuccess() {
 			c.Header("Set-Cookie", res.Header().Get("Set-Cookie"))
-			c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+			h.issued(c, config.ProviderNocoDB, "refresh_token", res.Cookies())
+			h.record(c, config.ProviderNocoDB, loginResultReusedCookie, "")
+			c.Redirect(http.StatusFound, returnURL(c, config.ProviderNocoDB))
 			return
 		}
 	}
 
-	res, err := h.client.R().SetContext(c).
+	username, password, ok := h.credentials(c, config.ProviderNocoDB)
+	if !ok {
+		return
+	}
+
+	res, err := h.upstreams.Client(config.ProviderNocoDB).R().SetContext(c).
 		SetBody(map[string]string{
-			"email":    viper.GetString(config.KeyNocoDBUsername),
-			"password": viper.GetString(config.KeyNocoDBPassword),
+			"email":    username,
+			"password": password,
 		}).
-		Post(JoinURL(viper.GetString(config.KeyNocoDBServerURL), "/auth/user/signin"))
+		Post(JoinURL(h.upstreams.ServerURL(config.ProviderNocoDB), "/auth/user/signin"))
 	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderNocoDB, loginFailureReason(config.ProviderNocoDB, nil, err), err)
 		return
 	}
 	if res.IsError() {
 		err := fmt.Errorf("failed to login to nocodb: %s %s", res.Status(), res)
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
+		h.fail(c, config.ProviderNocoDB, loginFailureReason(config.ProviderNocoDB, res, nil), err)
 		return
 	}
 
 	c.Header("Set-Cookie", res.Header().Get("Set-Cookie"))
-	c.Redirect(http.StatusFound, c.DefaultQuery("return_url", "/"))
+	h.issued(c, config.ProviderNocoDB, "refresh_token", res.Cookies())
+	h.record(c, config.ProviderNocoDB, loginResultSucceeded, "")
+	c.Redirect(http.StatusFound, returnURL(c, config.ProviderNocoDB))
 }
 
-func RegisterLoginHandler(e *gin.Engine) {
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+func RegisterLoginHandler(c cache.CacheInterface[string], u *upstream.Registry, a *audit.Auditor, l *ratelimit.Limiter, mp metric.MeterProvider, e *gin.Engine) error {
+	meter := mp.Meter(config.AppName)
+
+	attempts, err := meter.Int64Counter("login.attempts", metric.WithDescription("Number of login attempts by provider"))
+	if err != nil {
+		return err
+	}
+	results, err := meter.Int64Counter("login.results", metric.WithDescription("Number of login results by provider, result and failure reason"))
+	if err != nil {
+		return err
+	}
 
 	h := &LoginHandler{
-		logger: log.With().Str("logger", "loginHandler").Logger(),
-		client: resty.NewWithClient(&http.Client{
-			Transport: otelhttp.NewTransport(
-				customTransport,
-				otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
-					return otelhttptrace.NewClientTrace(ctx)
-				}),
-			),
-		}),
+		logger:    log.With().Str("logger", "loginHandler").Logger(),
+		upstreams: u,
+		cache:     c,
+		auditor:   a,
+		attempts:  attempts,
+		results:   results,
 	}
 
 	login := e.Group("/login")
 	{
-		login.GET("/proxmox", h.Proxmox)
-		login.GET("/argo-cd", h.ArgoCD)
-		login.GET("/ghost", h.Ghost)
-		login.GET("/n8n", h.N8N)
-		login.GET("/nocodb", h.NocoDB)
+		login.GET("/proxmox", h.interstitial(config.ProviderProxmox), l.Handler(ratelimit.RouteLogin, config.ProviderProxmox), h.attempt(config.ProviderProxmox), h.Proxmox)
+		login.GET("/argo-cd", h.interstitial(config.ProviderArgoCD), l.Handler(ratelimit.RouteLogin, config.ProviderArgoCD), h.attempt(config.ProviderArgoCD), h.ArgoCD)
+		login.GET("/ghost", h.interstitial(config.ProviderGhost), l.Handler(ratelimit.RouteLogin, config.ProviderGhost), h.attempt(config.ProviderGhost), h.Ghost)
+		login.GET("/n8n", h.interstitial(config.ProviderN8N), l.Handler(ratelimit.RouteLogin, config.ProviderN8N), h.attempt(config.ProviderN8N), h.N8N)
+		login.GET("/nocodb", h.interstitial(config.ProviderNocoDB), l.Handler(ratelimit.RouteLogin, config.ProviderNocoDB), h.attempt(config.ProviderNocoDB), h.NocoDB)
 	}
+
+	return nil
 }
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/eko/gocache/lib/v4/cache"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+	"github.com/wei840222/ory-oathkeeper-login/server/audit"
+	"github.com/wei840222/ory-oathkeeper-login/server/ratelimit"
+	"github.com/wei840222/ory-oathkeeper-login/server/upstream"
+)
+
+// newTestLogin serves the login handler with settings, e.g. the server URL
+// of a stand-in upstream.
+func newTestLogin(t *testing.T, c cache.CacheInterface[string], settings map[string]any) (*gin.Engine, *upstream.Registry) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	if err := config.InitViper(); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+
+	lc := fxtest.NewLifecycle(t)
+	mp := noop.NewMeterProvider()
+
+	u, err := upstream.NewRegistry(lc, mp, server.NewHealth(lc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := audit.NewAuditor(lc, mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := gin.New()
+	if err := RegisterLoginHandler(c, u, a, l, mp, e); err != nil {
+		t.Fatal(err)
+	}
+	return e, u
+}
+
+// newTestUpstream counts the requests it answers with code and body.
+func newTestUpstream(t *testing.T, code int, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestLoginSecretUnavailable(t *testing.T) {
+	srv, requests := newTestUpstream(t, http.StatusOK, `{"success":1,"data":{"ticket":"PVE:x"}}`)
+	e, u := newTestLogin(t, newTestCache(t), map[string]any{
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixServerURL):           srv.URL,
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixLockoutThreshold):    1,
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixLockoutCooldown):     "1m",
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixHealthCheckInterval): 0,
+		config.KeyProxmoxUsername: "admin",
+		config.KeyProxmoxPassword: "vault:secret/data/proxmox#password",
+	})
+
+	for range 3 {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login/proxmox", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+		}
+	}
+
+	if n := requests.Load(); n != 0 {
+		t.Errorf("upstream was called %d times with an unresolved password", n)
+	}
+	if remaining := u.Lockout(config.ProviderProxmox).Remaining(); remaining != 0 {
+		t.Errorf("logins are suspended for %s, an unavailable secret must not count as a rejection", remaining)
+	}
+}
+
+func TestLoginSucceeds(t *testing.T) {
+	srv, requests := newTestUpstream(t, http.StatusOK, `{"success":1,"data":{"ticket":"PVE:admin@pam:1::sig"}}`)
+	e, _ := newTestLogin(t, newTestCache(t), map[string]any{
+		config.ProviderKey(config.ProviderProxmox, config.KeySuffixServerURL): srv.URL,
+		config.KeyProxmoxUsername: "admin",
+		config.KeyProxmoxPassword: "hunter22",
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login/proxmox?return_url=https://pve.example.com/", nil))
+
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://pve.example.com/" {
+		t.Errorf("got %d to %q, want a redirect to the return URL", w.Code, w.Header().Get("Location"))
+	}
+	if requests.Load() != 1 {
+		t.Errorf("upstream was called %d times, want once", requests.Load())
+	}
+}
+
+func TestLoginFailureStatus(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name           string
+		code           int
+		body           string
+		serverURL      string
+		logins         int
+		want           int
+		wantRetryAfter string
+	}{
+		{name: "upstream error", code: http.StatusInternalServerError, logins: 1, want: http.StatusInternalServerError},
+		{name: "rejection below the threshold", code: http.StatusUnauthorized, logins: 1, want: http.StatusInternalServerError},
+		{name: "rejection suspending logins", code: http.StatusUnauthorized, logins: 2, want: http.StatusServiceUnavailable, wantRetryAfter: "60"},
+		{name: "upstream unreachable", serverURL: closed.URL, logins: 1, want: http.StatusServiceUnavailable, wantRetryAfter: "60"},
+		{name: "circuit open", code: http.StatusBadGateway, logins: 3, want: http.StatusServiceUnavailable, wantRetryAfter: "30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newTestUpstream(t, tt.code, tt.body)
+			if tt.serverURL == "" {
+				tt.serverURL = srv.URL
+			}
+			e, _ := newTestLogin(t, newTestCache(t), map[string]any{
+				config.ProviderKey(config.ProviderProxmox, config.KeySuffixServerURL):                      tt.serverURL,
+				config.ProviderKey(config.ProviderProxmox, config.KeySuffixLockoutThreshold):               2,
+				config.ProviderKey(config.ProviderProxmox, config.KeySuffixLockoutCooldown):                "1m",
+				config.ProviderKey(config.ProviderProxmox, config.KeySuffixCircuitBreakerFailureThreshold): 2,
+				config.ProviderKey(config.ProviderProxmox, config.KeySuffixCircuitBreakerOpenDuration):     "30s",
+				config.ProviderKey(config.ProviderProxmox, config.KeySuffixHealthCheckInterval):            0,
+				config.KeyProxmoxUsername: "admin",
+				config.KeyProxmoxPassword: "hunter22",
+			})
+
+			var w *httptest.ResponseRecorder
+			for range tt.logins {
+				w = httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/login/proxmox", nil)
+				r.Header.Set("Accept", "application/json")
+				e.ServeHTTP(w, r)
+			}
+			if w.Code != tt.want || w.Header().Get("Retry-After") != tt.wantRetryAfter {
+				t.Errorf("got %d with Retry-After %q, want %d with %q: %s", w.Code, w.Header().Get("Retry-After"), tt.want, tt.wantRetryAfter, w.Body)
+			}
+		})
+	}
+}
@@ -2,11 +2,14 @@ package handler
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"net/http/httptrace"
+	"os"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/eko/gocache/lib/v4/cache"
 	"github.com/eko/gocache/lib/v4/store"
@@ -14,13 +17,28 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/wei840222/ory-oathkeeper-login/config"
 	"github.com/wei840222/ory-oathkeeper-login/server"
+	"github.com/wei840222/ory-oathkeeper-login/server/audit"
+	"github.com/wei840222/ory-oathkeeper-login/server/ratelimit"
+	"github.com/wei840222/ory-oathkeeper-login/server/upstream"
+)
+
+const (
+	sessionResultCacheHit         = "cache_hit"
+	sessionResultStaleServed      = "stale_served"
+	sessionResultUpstreamValid    = "upstream_valid"
+	sessionResultUpstreamRejected = "upstream_rejected"
+	sessionResultFailOpen         = "fail_open"
+	sessionResultFailClosed       = "fail_closed"
+	sessionResultRevoked          = "revoked"
+
+	revalidateTimeout = 30 * time.Second
 )
 
 type OrySession struct {
@@ -30,283 +48,429 @@ type OrySession struct {
 	} `json:"extra"`
 }
 
+type cachedSession struct {
+	Session    OrySession `json:"session"`
+	ValidUntil time.Time  `json:"valid_until"`
+	Revoked    bool       `json:"revoked,omitempty"`
+}
+
+// sessionKeyPrefixes prefix the upstream session token in the cache key.
+var sessionKeyPrefixes = map[string]string{
+	config.ProviderProxmox: "proxmox",
+	config.ProviderArgoCD:  "argo-cd",
+	config.ProviderGhost:   "ghost",
+	config.ProviderN8N:     "n8n",
+	config.ProviderNocoDB:  "nocodb",
+}
+
+func sessionCacheKey(provider, sessionKey string) string {
+	return fmt.Sprintf("%s:%s", sessionKeyPrefixes[provider], sessionKey)
+}
+
+type sessionProvider struct {
+	name     string
+	cookie   func(c *gin.Context) (string, error)
+	validate func(ctx context.Context, header http.Header, sessionKey string) (OrySession, error)
+}
+
+// indexedSession tracks a session cached by this instance, the cache
+// backends cannot be enumerated. The subject is the Ory identity that last
+// checked the session, the account the upstream account it belongs to.
+type indexedSession struct {
+	provider  string
+	subject   string
+	account   string
+	expiresAt time.Time
+}
+
 type SessionHandler struct {
-	logger zerolog.Logger
-	client *resty.Client
-	cache  cache.CacheInterface[string]
+	logger       zerolog.Logger
+	upstreams    *upstream.Registry
+	auditor      *audit.Auditor
+	cache        cache.CacheInterface[string]
+	checks       metric.Int64Counter
+	revalidating sync.Map
+	sessions     sync.Map
+	resets       sync.Map
+	replica      string
 }
 
-func (h *SessionHandler) Proxmox(c *gin.Context) {
-	if ticket, err := c.Request.Cookie("PVEAuthCookie"); err == nil {
-		s, err := h.cache.Get(c, fmt.Sprintf("proxmox:%s", ticket.Value))
-		if err == nil {
-			h.logger.Debug().Str("session", s).Msg("session cache hit")
-			var session OrySession
-			if err := json.Unmarshal([]byte(s), &session); err == nil {
-				c.JSON(http.StatusOK, session)
-				return
-			} else {
-				h.logger.Warn().Err(err).Msg("session cache hit but unmarshal failed")
-				if err := h.cache.Delete(c, fmt.Sprintf("proxmox:%s", ticket.Value)); err != nil {
-					h.logger.Warn().Err(err).Msg("session cache delete failed")
-				}
-			}
-		} else {
-			h.logger.Debug().Err(err).Msg("session cache miss")
-		}
+func upstreamError(provider string, res *resty.Response, err error) error {
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", server.ErrUpstreamUnavailable, provider, err)
+	}
+	if res.StatusCode() >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: %s: %s", server.ErrUpstreamUnavailable, provider, res.Status())
+	}
+	return fmt.Errorf("%w: %s: %s", server.ErrInvalidSession, provider, res.Status())
+}
 
-		res, err := h.client.R().SetContext(c).
-			SetCookie(&http.Cookie{
-				Name:  "PVEAuthCookie",
-				Value: ticket.Value,
-			}).
-			Get(JoinURL(viper.GetString(config.KeyProxmoxServerURL), "/api2/extjs/version"))
-
-		if err == nil && res.IsSuccess() {
-			var session OrySession
-			session.Subject = viper.GetString(config.KeyProxmoxUsername)
-			b, err := json.Marshal(session)
-			if err != nil {
-				c.Error(err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-				return
-			}
+func (h *SessionHandler) validateProxmox(ctx context.Context, _ http.Header, ticket string) (OrySession, error) {
+	var session OrySession
+
+	res, err := h.upstreams.Client(config.ProviderProxmox).R().SetContext(ctx).
+		SetCookie(&http.Cookie{
+			Name:  "PVEAuthCookie",
+			Value: ticket,
+		}).
+		Get(JoinURL(h.upstreams.ServerURL(config.ProviderProxmox), "/api2/extjs/version"))
+	if err != nil || !res.IsSuccess() {
+		return session, upstreamError(config.ProviderProxmox, res, err)
+	}
 
-			if err := h.cache.Set(c, fmt.Sprintf("proxmox:%s", ticket.Value), string(b), store.WithExpiration(viper.GetDuration(config.KeyCacheTTL))); err != nil {
-				c.Error(err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-				return
-			}
+	session.Subject, err = config.Secret(config.KeyProxmoxUsername)
+	return session, err
+}
 
-			c.JSON(http.StatusOK, session)
-			return
-		}
+func (h *SessionHandler) validateArgoCD(ctx context.Context, _ http.Header, token string) (OrySession, error) {
+	var session OrySession
+
+	res, err := h.upstreams.Client(config.ProviderArgoCD).R().SetContext(ctx).
+		SetCookie(&http.Cookie{
+			Name:  "argocd.token",
+			Value: token,
+		}).
+		Get(JoinURL(h.upstreams.ServerURL(config.ProviderArgoCD), "/api/v1/session/userinfo"))
+	if err != nil || !res.IsSuccess() {
+		return session, upstreamError(config.ProviderArgoCD, res, err)
+	}
+	if !gjson.GetBytes(res.Body(), "loggedIn").Bool() {
+		return session, fmt.Errorf("%w: %s: not logged in", server.ErrInvalidSession, config.ProviderArgoCD)
 	}
 
-	c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
+	session.Subject = gjson.GetBytes(res.Body(), "username").String()
+	return session, nil
 }
 
-func (h *SessionHandler) ArgoCD(c *gin.Context) {
-	if sessionKey, err := c.Cookie("argocd.token"); err == nil {
-		s, err := h.cache.Get(c, fmt.Sprintf("argo-cd:%s", sessionKey))
-		if err == nil {
-			h.logger.Debug().Str("session", s).Msg("session cache hit")
-			var session OrySession
-			if err := json.Unmarshal([]byte(s), &session); err == nil {
-				c.JSON(http.StatusOK, session)
-				return
-			} else {
-				h.logger.Warn().Err(err).Msg("session cache hit but unmarshal failed")
-				if err := h.cache.Delete(c, fmt.Sprintf("argo-cd:%s", sessionKey)); err != nil {
-					h.logger.Warn().Err(err).Msg("session cache delete failed")
-				}
-			}
-		} else {
-			h.logger.Debug().Err(err).Msg("session cache miss")
-		}
+func (h *SessionHandler) validateGhost(ctx context.Context, _ http.Header, sessionKey string) (OrySession, error) {
+	var session OrySession
+
+	res, err := h.upstreams.Client(config.ProviderGhost).R().SetContext(ctx).
+		SetHeaders(map[string]string{
+			"X-Forwarded-Proto": "https",
+			"Origin":            config.Viper().GetString(config.KeyGhostOriginURL),
+		}).
+		SetCookie(&http.Cookie{
+			Name:  "ghost-admin-api-session",
+			Value: sessionKey,
+		}).
+		Get(JoinURL(h.upstreams.ServerURL(config.ProviderGhost), "/ghost/api/admin/users/me/"))
+	if err != nil || !res.IsSuccess() {
+		return session, upstreamError(config.ProviderGhost, res, err)
+	}
 
-		res, err := h.client.R().SetContext(c).
-			SetCookie(&http.Cookie{
-				Name:  "argocd.token",
-				Value: sessionKey,
-			}).
-			Get(JoinURL(viper.GetString(config.KeyArgoCDServerURL), "/api/v1/session/userinfo"))
-
-		if err == nil && res.IsSuccess() && gjson.GetBytes(res.Body(), "loggedIn").Bool() {
-			var session OrySession
-			session.Subject = gjson.GetBytes(res.Body(), "username").String()
-			b, err := json.Marshal(session)
-			if err != nil {
-				c.Error(err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-				return
-			}
+	session.Subject = gjson.GetBytes(res.Body(), "users.0.id").String()
+	session.Extra.Email = gjson.GetBytes(res.Body(), "users.0.email").String()
+	return session, nil
+}
 
-			if err := h.cache.Set(c, fmt.Sprintf("argo-cd:%s", sessionKey), string(b), store.WithExpiration(viper.GetDuration(config.KeyCacheTTL))); err != nil {
-				c.Error(err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-				return
-			}
+func (h *SessionHandler) validateN8N(ctx context.Context, header http.Header, auth string) (OrySession, error) {
+	var session OrySession
+
+	res, err := h.upstreams.Client(config.ProviderN8N).R().SetContext(ctx).
+		SetHeader("Browser-Id", header.Get("Browser-Id")).
+		SetCookie(&http.Cookie{
+			Name:  "n8n-auth",
+			Value: auth,
+		}).
+		Get(JoinURL(h.upstreams.ServerURL(config.ProviderN8N), "/rest/login"))
+	if err != nil || !res.IsSuccess() {
+		return session, upstreamError(config.ProviderN8N, res, err)
+	}
 
-			c.JSON(http.StatusOK, session)
-			return
+	session.Subject = gjson.GetBytes(res.Body(), "data.id").String()
+	session.Extra.Email = gjson.GetBytes(res.Body(), "data.email").String()
+	return session, nil
+}
+
+func (h *SessionHandler) validateNocoDB(context.Context, http.Header, string) (OrySession, error) {
+	var session OrySession
+	var err error
+	session.Subject, err = config.Secret(config.KeyNocoDBUsername)
+	return session, err
+}
+
+func (h *SessionHandler) lookup(ctx context.Context, key string) (cachedSession, bool) {
+	var entry cachedSession
+
+	s, err := h.cache.Get(ctx, key)
+	if err != nil {
+		h.logger.Debug().Err(err).Msg("session cache miss")
+		return entry, false
+	}
+
+	if err := json.Unmarshal([]byte(s), &entry); err != nil || entry.ValidUntil.IsZero() {
+		h.logger.Warn().Err(err).Msg("session cache hit but unmarshal failed")
+		if err := h.forget(ctx, key); err != nil {
+			h.logger.Warn().Err(err).Msg("session cache delete failed")
 		}
+		return entry, false
 	}
+	h.logger.Debug().Str("subject", entry.Session.Subject).Time("validUntil", entry.ValidUntil).Msg("session cache hit")
 
-	c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
+	return entry, true
 }
 
-func (h *SessionHandler) Ghost(c *gin.Context) {
-	if sessionKey, err := c.Cookie("ghost-admin-api-session"); err == nil {
-		s, err := h.cache.Get(c, fmt.Sprintf("ghost:%s", sessionKey))
-		if err == nil {
-			h.logger.Debug().Str("session", s).Msg("session cache hit")
-			var session OrySession
-			if err := json.Unmarshal([]byte(s), &session); err == nil {
-				c.JSON(http.StatusOK, session)
-				return
-			} else {
-				h.logger.Warn().Err(err).Msg("session cache hit but unmarshal failed")
-				if err := h.cache.Delete(c, fmt.Sprintf("ghost:%s", sessionKey)); err != nil {
-					h.logger.Warn().Err(err).Msg("session cache delete failed")
-				}
-			}
-		} else {
-			h.logger.Debug().Err(err).Msg("session cache miss")
+func (h *SessionHandler) store(ctx context.Context, p sessionProvider, key, subject string, session OrySession) error {
+	ttl := config.Viper().GetDuration(config.KeyCacheTTL)
+	retention := ttl
+	if config.Viper().GetString(config.ProviderKey(p.name, config.KeySuffixSessionPolicy)) != config.SessionPolicyFailClosed {
+		retention += config.Viper().GetDuration(config.ProviderKey(p.name, config.KeySuffixSessionGrace))
+	}
+
+	b, err := json.Marshal(cachedSession{
+		Session:    session,
+		ValidUntil: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := h.cache.Set(ctx, key, string(b), store.WithExpiration(retention)); err != nil {
+		return err
+	}
+
+	h.sessions.Store(key, indexedSession{
+		provider:  p.name,
+		subject:   subject,
+		account:   session.Subject,
+		expiresAt: time.Now().Add(retention),
+	})
+	return nil
+}
+
+func (h *SessionHandler) forget(ctx context.Context, key string) error {
+	h.sessions.Delete(key)
+	return h.cache.Delete(ctx, key)
+}
+
+func (h *SessionHandler) observeActive(_ context.Context, o metric.Int64Observer) error {
+	active := make(map[string]int64, len(config.AllProviders))
+	for _, p := range config.AllProviders {
+		active[p] = 0
+	}
+
+	now := time.Now()
+	h.sessions.Range(func(key, value any) bool {
+		s := value.(indexedSession)
+		if now.After(s.expiresAt) {
+			h.sessions.Delete(key)
+			return true
 		}
+		active[s.provider]++
+		return true
+	})
 
-		res, err := h.client.R().SetContext(c).
-			SetHeaders(map[string]string{
-				"X-Forwarded-Proto": "https",
-				"Origin":            viper.GetString(config.KeyGhostOriginURL),
-			}).
-			SetCookie(&http.Cookie{
-				Name:  "ghost-admin-api-session",
-				Value: sessionKey,
-			}).
-			Get(JoinURL(viper.GetString(config.KeyGhostServerURL), "/ghost/api/admin/users/me/"))
-
-		if err == nil && res.IsSuccess() {
-			var session OrySession
-			session.Subject = gjson.GetBytes(res.Body(), "users.0.id").String()
-			session.Extra.Email = gjson.GetBytes(res.Body(), "users.0.email").String()
-			b, err := json.Marshal(session)
-			if err != nil {
-				c.Error(err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-				return
-			}
+	for provider, n := range active {
+		o.Observe(n, metric.WithAttributes(attribute.String("provider", provider)))
+	}
+	return nil
+}
 
-			if err := h.cache.Set(c, fmt.Sprintf("ghost:%s", sessionKey), string(b), store.WithExpiration(viper.GetDuration(config.KeyCacheTTL))); err != nil {
-				c.Error(err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-				return
+func (h *SessionHandler) revalidate(c *gin.Context, p sessionProvider, key, sessionKey string) {
+	if _, loaded := h.revalidating.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	ctx := context.WithoutCancel(c.Request.Context())
+	header := c.Request.Header.Clone()
+
+	go func() {
+		defer h.revalidating.Delete(key)
+
+		ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+		defer cancel()
+
+		session, err := p.validate(ctx, header, sessionKey)
+		switch {
+		case err == nil:
+			if err := h.store(ctx, p, key, header.Get(config.Viper().GetString(config.KeySubjectHeader)), session); err != nil {
+				h.logger.Warn().Err(err).Str("provider", p.name).Msg("session revalidated but cache set failed")
+			}
+		case errors.Is(err, server.ErrInvalidSession):
+			if err := h.forget(ctx, key); err != nil {
+				h.logger.Warn().Err(err).Msg("session cache delete failed")
 			}
+		default:
+			h.logger.Warn().Err(err).Str("provider", p.name).Msg("session revalidation failed, keeping stale session")
+		}
+	}()
+}
 
-			c.JSON(http.StatusOK, session)
+func (h *SessionHandler) record(c *gin.Context, p sessionProvider, result, account string) {
+	h.checks.Add(c, 1, metric.WithAttributes(
+		attribute.String("provider", p.name),
+		attribute.String("result", result),
+	))
+	trace.SpanFromContext(c).SetAttributes(
+		attribute.String("provider", p.name),
+		attribute.String("session.result", result),
+	)
+
+	if result == sessionResultCacheHit && !config.Viper().GetBool(config.KeyAuditIncludeCacheHits) {
+		return
+	}
+	event := audit.EventSessionValidated
+	if result == sessionResultUpstreamRejected || result == sessionResultFailClosed || result == sessionResultRevoked {
+		event = audit.EventSessionRejected
+	}
+	e := h.auditor.Event(c, event, p.name)
+	e.Account = account
+	e.Instance = h.upstreams.ServerURL(p.name)
+	e.Result = result
+	h.auditor.Record(e)
+}
+
+func (h *SessionHandler) handle(p sessionProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionKey, err := p.cookie(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
 			return
 		}
-	}
 
-	c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
-}
+		key := sessionCacheKey(p.name, sessionKey)
+		if h.upstreamSessionReset(c, p.name, sessionKey) {
+			h.record(c, p, sessionResultRevoked, "")
+			c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
+			return
+		}
 
-func (h *SessionHandler) N8N(c *gin.Context) {
-	if sessionKey, err := c.Cookie("n8n-auth"); err == nil {
-		s, err := h.cache.Get(c, fmt.Sprintf("n8n:%s", sessionKey))
-		if err == nil {
-			h.logger.Debug().Str("session", s).Msg("session cache hit")
-			var session OrySession
-			if err := json.Unmarshal([]byte(s), &session); err == nil {
-				c.JSON(http.StatusOK, session)
-				return
-			} else {
-				h.logger.Warn().Err(err).Msg("session cache hit but unmarshal failed")
-				if err := h.cache.Delete(c, fmt.Sprintf("n8n:%s", sessionKey)); err != nil {
-					h.logger.Warn().Err(err).Msg("session cache delete failed")
-				}
-			}
-		} else {
-			h.logger.Debug().Err(err).Msg("session cache miss")
+		policy := config.Viper().GetString(config.ProviderKey(p.name, config.KeySuffixSessionPolicy))
+		grace := config.Viper().GetDuration(config.ProviderKey(p.name, config.KeySuffixSessionGrace))
+
+		entry, found := h.lookup(c, key)
+		trace.SpanFromContext(c).SetAttributes(
+			attribute.Bool("session.cache_hit", found),
+			attribute.String("session.policy", policy),
+		)
+		if found && entry.Revoked {
+			h.record(c, p, sessionResultRevoked, entry.Session.Subject)
+			c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
+			return
+		}
+		if found && time.Now().Before(entry.ValidUntil) {
+			h.record(c, p, sessionResultCacheHit, entry.Session.Subject)
+			c.JSON(http.StatusOK, entry.Session)
+			return
 		}
 
-		res, err := h.client.R().SetContext(c).
-			SetHeader("Browser-Id", c.GetHeader("Browser-Id")).
-			SetCookie(&http.Cookie{
-				Name:  "n8n-auth",
-				Value: sessionKey,
-			}).
-			Get(JoinURL(viper.GetString(config.KeyN8NServerURL), "/rest/login"))
-
-		if err == nil && res.IsSuccess() {
-			var session OrySession
-			session.Subject = gjson.GetBytes(res.Body(), "data.id").String()
-			session.Extra.Email = gjson.GetBytes(res.Body(), "data.email").String()
-			b, err := json.Marshal(session)
-			if err != nil {
-				c.Error(err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-				return
-			}
+		if found && policy == config.SessionPolicyStaleWhileRevalidate && time.Now().Before(entry.ValidUntil.Add(grace)) {
+			h.revalidate(c, p, key, sessionKey)
+			h.record(c, p, sessionResultStaleServed, entry.Session.Subject)
+			c.JSON(http.StatusOK, entry.Session)
+			return
+		}
 
-			if err := h.cache.Set(c, fmt.Sprintf("n8n:%s", sessionKey), string(b), store.WithExpiration(viper.GetDuration(config.KeyCacheTTL))); err != nil {
+		session, err := p.validate(c, c.Request.Header, sessionKey)
+		switch {
+		case err == nil:
+			if err := h.store(c, p, key, c.GetHeader(config.Viper().GetString(config.KeySubjectHeader)), session); err != nil {
 				c.Error(err)
 				c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
 				return
 			}
 
+			h.record(c, p, sessionResultUpstreamValid, session.Subject)
 			c.JSON(http.StatusOK, session)
-			return
-		}
-	}
+		case errors.Is(err, server.ErrInvalidSession):
+			if found {
+				if err := h.forget(c, key); err != nil {
+					h.logger.Warn().Err(err).Msg("session cache delete failed")
+				}
+			}
 
-	c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
-}
+			h.record(c, p, sessionResultUpstreamRejected, entry.Session.Subject)
+			c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
+		default:
+			h.logger.Warn().Err(err).Str("provider", p.name).Str("policy", policy).Msg("session validation failed, upstream unavailable")
 
-func (h *SessionHandler) NocoDB(c *gin.Context) {
-	if sessionKey, err := c.Cookie("refresh_token"); err == nil {
-		s, err := h.cache.Get(c, fmt.Sprintf("nocodb:%s", sessionKey))
-		if err == nil {
-			h.logger.Debug().Str("session", s).Msg("session cache hit")
-			var session OrySession
-			if err := json.Unmarshal([]byte(s), &session); err == nil {
-				c.JSON(http.StatusOK, session)
+			allowlist := config.Viper().GetStringSlice(config.ProviderKey(p.name, config.KeySuffixSessionFailOpenAllowlist))
+			if found && policy == config.SessionPolicyFailOpen && time.Now().Before(entry.ValidUntil.Add(grace)) && slices.Contains(allowlist, entry.Session.Subject) {
+				h.record(c, p, sessionResultFailOpen, entry.Session.Subject)
+				c.JSON(http.StatusOK, entry.Session)
 				return
-			} else {
-				h.logger.Warn().Err(err).Msg("session cache hit but unmarshal failed")
-				if err := h.cache.Delete(c, fmt.Sprintf("nocodb:%s", sessionKey)); err != nil {
-					h.logger.Warn().Err(err).Msg("session cache delete failed")
-				}
 			}
-		} else {
-			h.logger.Debug().Err(err).Msg("session cache miss")
-		}
 
-		var session OrySession
-		session.Subject = viper.GetString(config.KeyNocoDBUsername)
-		b, err := json.Marshal(session)
-		if err != nil {
-			c.Error(err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-			return
+			h.record(c, p, sessionResultFailClosed, entry.Session.Subject)
+			c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
 		}
+	}
+}
 
-		if err := h.cache.Set(c, fmt.Sprintf("nocodb:%s", sessionKey), string(b), store.WithExpiration(viper.GetDuration(config.KeyCacheTTL))); err != nil {
-			c.Error(err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, server.ErrorRes{Error: err.Error()})
-			return
-		}
+func RegisterSessionHandler(c cache.CacheInterface[string], u *upstream.Registry, a *audit.Auditor, l *ratelimit.Limiter, admin *server.Admin, mp metric.MeterProvider, e *gin.Engine) error {
+	checks, err := mp.Meter(config.AppName).Int64Counter("session.checks", metric.WithDescription("Number of session checks by provider and result"))
+	if err != nil {
+		return err
+	}
 
-		c.JSON(http.StatusOK, session)
-		return
+	h := &SessionHandler{
+		logger:    log.With().Str("logger", "sessionHandler").Logger(),
+		upstreams: u,
+		auditor:   a,
+		cache:     c,
+		checks:    checks,
+	}
+	if h.replica, err = os.Hostname(); err != nil {
+		return err
 	}
 
-	c.JSON(http.StatusUnauthorized, server.ErrorRes{Error: server.ErrInvalidSession.Error()})
-}
+	if _, err := mp.Meter(config.AppName).Int64ObservableGauge("session.cache.active",
+		metric.WithDescription("Number of unexpired sessions cached by this instance by provider"),
+		metric.WithInt64Callback(h.observeActive),
+	); err != nil {
+		return err
+	}
 
-func RegisterSessionHandler(e *gin.Engine, c cache.CacheInterface[string]) {
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	cookie := func(name string) func(c *gin.Context) (string, error) {
+		return func(c *gin.Context) (string, error) {
+			return c.Cookie(name)
+		}
+	}
 
-	h := &SessionHandler{
-		logger: log.With().Str("logger", "sessionHandler").Logger(),
-		client: resty.NewWithClient(&http.Client{
-			Transport: otelhttp.NewTransport(
-				customTransport,
-				otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
-					return otelhttptrace.NewClientTrace(ctx)
-				}),
-			),
-		}),
-		cache: c,
+	session := e.Group("/session", server.RequireClientCertificate())
+	{
+		session.GET("/proxmox", l.Handler(ratelimit.RouteSession, config.ProviderProxmox), h.handle(sessionProvider{
+			name: config.ProviderProxmox,
+			// the ticket is forwarded as is, c.Cookie would unescape it
+			cookie: func(c *gin.Context) (string, error) {
+				ticket, err := c.Request.Cookie("PVEAuthCookie")
+				if err != nil {
+					return "", err
+				}
+				return ticket.Value, nil
+			},
+			validate: h.validateProxmox,
+		}))
+		session.GET("/argo-cd", l.Handler(ratelimit.RouteSession, config.ProviderArgoCD), h.handle(sessionProvider{
+			name:     config.ProviderArgoCD,
+			cookie:   cookie("argocd.token"),
+			validate: h.validateArgoCD,
+		}))
+		session.GET("/ghost", l.Handler(ratelimit.RouteSession, config.ProviderGhost), h.handle(sessionProvider{
+			name:     config.ProviderGhost,
+			cookie:   cookie("ghost-admin-api-session"),
+			validate: h.validateGhost,
+		}))
+		session.GET("/n8n", l.Handler(ratelimit.RouteSession, config.ProviderN8N), h.handle(sessionProvider{
+			name:     config.ProviderN8N,
+			cookie:   cookie("n8n-auth"),
+			validate: h.validateN8N,
+		}))
+		session.GET("/nocodb", l.Handler(ratelimit.RouteSession, config.ProviderNocoDB), h.handle(sessionProvider{
+			name:     config.ProviderNocoDB,
+			cookie:   cookie("refresh_token"),
+			validate: h.validateNocoDB,
+		}))
 	}
 
-	session := e.Group("/session")
+	sessions := admin.Group("/sessions")
 	{
-		session.GET("/proxmox", h.Proxmox)
-		session.GET("/argo-cd", h.ArgoCD)
-		session.GET("/ghost", h.Ghost)
-		session.GET("/n8n", h.N8N)
-		session.GET("/nocodb", h.NocoDB)
+		sessions.GET("", h.ListSessions)
+		sessions.DELETE("", h.RevokeSessions)
+		sessions.DELETE("/:id", h.RevokeSession)
 	}
+	admin.Group("/upstream-sessions").DELETE("/:provider", h.ResetUpstreamSessions)
+
+	return nil
 }
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"fmt"
+	"net/url"
 	"path"
 	"strings"
 )
@@ -10,3 +11,13 @@ func JoinURL(base string, paths ...string) string {
 	p := path.Join(paths...)
 	return fmt.Sprintf("%s/%s", strings.TrimRight(base, "/"), strings.TrimLeft(p, "/"))
 }
+
+// httpURL returns u when it is relative or an http or https URL, otherwise
+// fallback.
+func httpURL(u, fallback string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "" && parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fallback
+	}
+	return u
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+var (
+	errNotProbed    = errors.New("not probed yet")
+	errStarting     = errors.New("service is starting")
+	errShuttingDown = errors.New("service is shutting down")
+)
+
+const (
+	stateStarting int32 = iota
+	stateServing
+	stateDraining
+)
+
+type HealthCheck func(ctx context.Context) error
+
+type CheckStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	Latency   string    `json:"latency"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type healthCheck struct {
+	check HealthCheck
+	// probes run periodically in the background, other checks on every request
+	probe bool
+	// readiness fails only while a critical check fails
+	critical bool
+	last     CheckStatus
+}
+
+type Health struct {
+	mu     sync.RWMutex
+	checks map[string]*healthCheck
+	state  atomic.Int32
+}
+
+func NewHealth(lc fx.Lifecycle) *Health {
+	h := &Health{
+		checks: make(map[string]*healthCheck),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+
+				for {
+					v := config.Viper()
+					h.runProbes(ctx, v.GetDuration(config.KeyO11yProbeTimeout))
+
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(v.GetDuration(config.KeyO11yProbeInterval)):
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			<-done
+			return nil
+		},
+	})
+
+	return h
+}
+
+// Serving returns nil once every component has started, until the service
+// starts shutting down.
+func (h *Health) Serving() error {
+	switch h.state.Load() {
+	case stateStarting:
+		return errStarting
+	case stateDraining:
+		return errShuttingDown
+	default:
+		return nil
+	}
+}
+
+// Register adds a cheap check that is run on every readiness request. Only
+// local dependencies, such as the cache, should be critical: a failing
+// upstream would otherwise take every replica out of service at once.
+func (h *Health) Register(name string, critical bool, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks[name] = &healthCheck{check: check, critical: critical}
+}
+
+// RegisterProbe adds a check that is run in the background every probe
+// interval, the last result is reported.
+func (h *Health) RegisterProbe(name string, critical bool, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks[name] = &healthCheck{
+		check:    check,
+		probe:    true,
+		critical: critical,
+		last:     CheckStatus{Name: name, Critical: critical, Error: errNotProbed.Error()},
+	}
+}
+
+// Ready returns nil while the service is serving and no critical check
+// fails, otherwise the failing checks.
+func (h *Health) Ready(ctx context.Context) error {
+	if err := h.Serving(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, c := range h.Check(ctx) {
+		if c.Critical && !c.Healthy {
+			errs = append(errs, fmt.Errorf("%s: %s", c.Name, c.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func run(ctx context.Context, name string, critical bool, check HealthCheck) CheckStatus {
+	start := time.Now()
+	err := check(ctx)
+
+	status := CheckStatus{
+		Name:      name,
+		Healthy:   err == nil,
+		Critical:  critical,
+		Latency:   time.Since(start).String(),
+		CheckedAt: start,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func (h *Health) runProbes(ctx context.Context, timeout time.Duration) {
+	h.mu.RLock()
+	probes := make(map[string]healthCheck)
+	for name, c := range h.checks {
+		if c.probe {
+			probes[name] = *c
+		}
+	}
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for name, c := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			status := run(ctx, name, c.critical, c.check)
+			if errors.Is(ctx.Err(), context.Canceled) {
+				// shutting down, the result says nothing about the dependency
+				return
+			}
+
+			h.mu.Lock()
+			h.checks[name].last = status
+			h.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// Check returns the status of every check sorted by name.
+func (h *Health) Check(ctx context.Context) []CheckStatus {
+	h.mu.RLock()
+	checks := make(map[string]healthCheck, len(h.checks))
+	for name, c := range h.checks {
+		checks[name] = *c
+	}
+	h.mu.RUnlock()
+
+	results := make([]CheckStatus, 0, len(checks))
+	for name, c := range checks {
+		if c.probe {
+			results = append(results, c.last)
+		} else {
+			results = append(results, run(ctx, name, c.critical, c.check))
+		}
+	}
+
+	slices.SortFunc(results, func(a, b CheckStatus) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return results
+}
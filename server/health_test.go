@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/fx/fxtest"
+)
+
+func TestHealthReady(t *testing.T) {
+	failing := func(context.Context) error { return errors.New("unavailable") }
+	passing := func(context.Context) error { return nil }
+
+	tests := []struct {
+		name     string
+		state    int32
+		critical HealthCheck
+		upstream HealthCheck
+		wantErr  string
+	}{
+		{name: "starting", state: stateStarting, critical: passing, upstream: passing, wantErr: errStarting.Error()},
+		{name: "healthy", state: stateServing, critical: passing, upstream: passing},
+		{name: "upstream unavailable", state: stateServing, critical: passing, upstream: failing},
+		{name: "cache unavailable", state: stateServing, critical: failing, upstream: passing, wantErr: "cache: unavailable"},
+		{name: "draining", state: stateDraining, critical: passing, upstream: passing, wantErr: errShuttingDown.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealth(fxtest.NewLifecycle(t))
+			h.state.Store(tt.state)
+			h.Register("cache", true, tt.critical)
+			h.Register("upstream.ghost.credentials", false, tt.upstream)
+
+			err := h.Ready(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Ready() = %v, want ready", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Ready() = %v, want %q", err, tt.wantErr)
+			}
+
+			for _, c := range h.Check(context.Background()) {
+				if c.Critical != (c.Name == "cache") {
+					t.Errorf("%s: critical = %v", c.Name, c.Critical)
+				}
+			}
+		})
+	}
+}
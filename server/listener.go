@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+type listenAddressKey struct{}
+
+// ListenAddressFromContext returns the listener a request was received on.
+func ListenAddressFromContext(ctx context.Context) (config.ListenAddress, bool) {
+	addr, ok := ctx.Value(listenAddressKey{}).(config.ListenAddress)
+	return addr, ok
+}
+
+func listenUnix(addr config.ListenAddress) (net.Listener, error) {
+	// a socket left behind by a killed process fails the bind
+	if fi, err := os.Lstat(addr.Address); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", addr.Address)
+		}
+		if err := os.Remove(addr.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(config.ListenNetworkUnix, addr.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.Mode != 0 {
+		if err := os.Chmod(addr.Address, addr.Mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if addr.Group != "" {
+		g, err := user.LookupGroup(addr.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(addr.Group); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		if err := os.Chown(addr.Address, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// listenFDsStart is the first file descriptor passed by systemd, the ones
+// after stdin, stdout and stderr.
+var listenFDsStart = 3
+
+// listenSystemd returns a socket passed by systemd socket activation, by its
+// FileDescriptorName or its index.
+func listenSystemd(name string) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := range n {
+		if (i < len(names) && names[i] == name) || strconv.Itoa(i) == name {
+			f := os.NewFile(uintptr(listenFDsStart+i), name)
+			defer f.Close()
+			return net.FileListener(f)
+		}
+	}
+	return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+}
+
+func listen(addr config.ListenAddress) (net.Listener, error) {
+	switch addr.Network {
+	case config.ListenNetworkUnix:
+		return listenUnix(addr)
+	case config.ListenNetworkSystemd:
+		return listenSystemd(addr.Address)
+	default:
+		return net.Listen(config.ListenNetworkTCP, addr.Address)
+	}
+}
+
+// restrictRoutes answers 404 to requests for a route group that is not
+// served on the listener.
+func restrictRoutes(routes []string, next http.Handler) http.Handler {
+	if len(routes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if !slices.Contains(routes, group) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorRes{Error: http.StatusText(http.StatusNotFound)})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve serves handler on every listener until the app stops, TLS is served
+// on the listeners that ask for it when tlsConfig is not nil.
+func serve(lc fx.Lifecycle, logger zerolog.Logger, addrs []config.ListenAddress, handler http.Handler, tlsConfig *tls.Config) {
+	servers := make([]*http.Server, len(addrs))
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			listeners := make([]net.Listener, 0, len(addrs))
+			for _, addr := range addrs {
+				l, err := listen(addr)
+				if err != nil {
+					for _, l := range listeners {
+						l.Close()
+					}
+					return fmt.Errorf("failed to listen on %s: %w", addr.URL, err)
+				}
+				listeners = append(listeners, l)
+			}
+
+			for i, addr := range addrs {
+				srv := &http.Server{
+					Handler: restrictRoutes(addr.Routes, handler),
+					ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+						return context.WithValue(ctx, listenAddressKey{}, addr)
+					},
+				}
+				serve := func() error { return srv.Serve(listeners[i]) }
+				if tlsConfig != nil && addr.TLS {
+					srv.TLSConfig = tlsConfig
+					serve = func() error { return srv.ServeTLS(listeners[i], "", "") }
+				}
+				servers[i] = srv
+
+				logger.Info().Str("listener", addr.URL).Strs("routes", addr.Routes).Bool("tls", srv.TLSConfig != nil).Msg("listening")
+				go func() {
+					if err := serve(); err != nil && err != http.ErrServerClosed {
+						panic(err)
+					}
+				}()
+			}
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			logger.Info().Msg("closing listeners, waiting for in-flight requests")
+			defer logger.Info().Msg("stopped")
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(servers))
+			for i, srv := range servers {
+				if srv == nil {
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs[i] = srv.Shutdown(ctx)
+				}()
+			}
+			wg.Wait()
+			return errors.Join(errs...)
+		},
+	})
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// passSystemdSocket passes a TCP socket the way systemd socket activation
+// does, named name after the sockets named before, and returns its address.
+func passSystemdSocket(t *testing.T, name string, before ...string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// listenSystemd takes over the descriptor, f keeps its own
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := listenFDsStart
+	listenFDsStart = fd - len(before)
+	t.Cleanup(func() { listenFDsStart = prev })
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(before)+1))
+	t.Setenv("LISTEN_FDNAMES", strings.Join(append(before, name), ":"))
+	return l.Addr().String()
+}
+
+func TestListenSystemd(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		pid     string
+		wantErr string
+	}{
+		{name: "by name", address: "http"},
+		{name: "by index", address: "1"},
+		{name: "unknown name", address: "metrics", wantErr: `no socket named "metrics"`},
+		{name: "passed to another process", address: "http", pid: "1", wantErr: "no sockets passed by systemd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := passSystemdSocket(t, "http", "o11y")
+			if tt.pid != "" {
+				t.Setenv("LISTEN_PID", tt.pid)
+			}
+
+			l, err := listenSystemd(tt.address)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("listenSystemd() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			if l.Addr().String() != addr {
+				t.Errorf("listenSystemd() listens on %s, want the passed socket on %s", l.Addr(), addr)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing func(path string) error
+		wantErr  string
+	}{
+		{name: "new socket"},
+		{
+			name: "socket left behind",
+			existing: func(path string) error {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					return err
+				}
+				// keeps the file, as a killed process would
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				return l.Close()
+			},
+		},
+		{
+			name:     "not a socket",
+			existing: func(path string) error { return os.WriteFile(path, nil, 0o600) },
+			wantErr:  "is not a socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session.sock")
+			if tt.existing != nil {
+				if err := tt.existing(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			l, err := listenUnix(config.ListenAddress{Network: config.ListenNetworkUnix, Address: path, Mode: 0o660, Group: strconv.Itoa(os.Getgid())})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("listenUnix() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode()&fs.ModeSocket == 0 || fi.Mode().Perm() != 0o660 {
+				t.Errorf("socket mode = %s, want a socket with 0660", fi.Mode())
+			}
+		})
+	}
+}
+
+func TestServeSkipsClientCertificateOnUnixSockets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyHTTPTLSClientCAFile, "ca.crt")
+
+	e := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	e.GET("/session/ghost", RequireClientCertificate(), ok)
+	e.GET("/login/ghost", ok)
+
+	socket := filepath.Join(t.TempDir(), "session.sock")
+	tcp := passSystemdSocket(t, "http")
+	addrs := []config.ListenAddress{
+		{URL: "unix://" + socket, Network: config.ListenNetworkUnix, Address: socket, Routes: []string{"session"}},
+		{URL: "systemd://http", Network: config.ListenNetworkSystemd, Address: "http"},
+	}
+
+	lc := fxtest.NewLifecycle(t)
+	serve(lc, zerolog.Nop(), addrs, e, nil)
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	overUnix := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	tests := []struct {
+		name   string
+		client *http.Client
+		url    string
+		want   int
+	}{
+		{name: "session over the unix socket", client: overUnix, url: "http://unix/session/ghost", want: http.StatusOK},
+		{name: "route not served on the unix socket", client: overUnix, url: "http://unix/login/ghost", want: http.StatusNotFound},
+		{name: "session over TCP without a certificate", client: http.DefaultClient, url: "http://" + tcp + "/session/ghost", want: http.StatusForbidden},
+		{name: "login over TCP", client: http.DefaultClient, url: "http://" + tcp + "/login/ghost", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := tt.client.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -2,17 +2,23 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"slices"
+	"strings"
 
 	otelpyroscope "github.com/grafana/otel-profiling-go"
 	_ "github.com/grafana/pyroscope-go/godeltaprof/http/pprof"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
@@ -25,6 +31,49 @@ import (
 	"github.com/wei840222/ory-oathkeeper-login/config"
 )
 
+func newSpanExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	endpoint := viper.GetString(config.KeyTraceEndpoint)
+	headers := viper.GetStringMapString(config.KeyTraceHeaders)
+	insecure := viper.GetBool(config.KeyTraceInsecure)
+
+	switch exporter := viper.GetString(config.KeyTraceExporter); exporter {
+	case config.TraceExporterOTLPGRPC:
+		var opts []otlptracegrpc.Option
+		if strings.Contains(endpoint, "://") {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(endpoint))
+		} else if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(headers))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case config.TraceExporterOTLPHTTP:
+		var opts []otlptracehttp.Option
+		if strings.Contains(endpoint, "://") {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		} else if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case config.TraceExporterStdout:
+		return stdouttrace.New()
+	case config.TraceExporterNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+}
+
 func NewTracerProvider(lc fx.Lifecycle) (trace.TracerProvider, error) {
 	r, err := resource.Merge(
 		resource.Default(),
@@ -37,22 +86,27 @@ func NewTracerProvider(lc fx.Lifecycle) (trace.TracerProvider, error) {
 		return nil, err
 	}
 
-	exp, err := otlptracegrpc.New(context.Background())
+	exp, err := newSpanExporter(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithBatcher(exp),
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64(config.KeyTraceSampleRatio)))),
 		sdktrace.WithResource(r),
-	)
+	}
+	// without an exporter spans are still created so trace IDs propagate and show up in logs
+	if exp != nil {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
 	ptp := otelpyroscope.NewTracerProvider(tp)
 	otel.SetTracerProvider(otelpyroscope.NewTracerProvider(ptp))
 	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
+			log.Info().Str("logger", "trace").Msg("flushing spans")
 			return tp.Shutdown(ctx)
 		},
 	})
@@ -74,6 +128,7 @@ func NewMeterProvider(lc fx.Lifecycle) (metric.MeterProvider, error) {
 
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
+			log.Info().Str("logger", "metric").Msg("flushing metrics")
 			return provider.Shutdown(ctx)
 		},
 	})
@@ -81,39 +136,69 @@ func NewMeterProvider(lc fx.Lifecycle) (metric.MeterProvider, error) {
 	return provider, nil
 }
 
-func RunO11yHTTPServer(lc fx.Lifecycle) {
-	mux := http.NewServeMux()
-	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", viper.GetString(config.KeyO11yHost), viper.GetInt(config.KeyO11yPort)),
-		Handler: mux,
+type StatusRes struct {
+	Status string        `json:"status"`
+	Checks []CheckStatus `json:"checks"`
+}
+
+func RunO11yHTTPServer(lc fx.Lifecycle, health *Health, admin *Admin, serverTLS *ServerTLS) error {
+	addrs, err := config.ListenAddresses(viper.GetViper(), config.KeyO11yListen, config.KeyO11yHost, config.KeyO11yPort, config.O11yRouteGroups, false)
+	if err != nil {
+		return err
 	}
 
-	var isShuttingDown bool
+	mux := http.NewServeMux()
+
 	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
-		if !isShuttingDown {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
-		} else {
+		if err := health.Serving(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := health.Ready(r.Context()); err != nil {
 			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Service is shutting down"))
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		res := StatusRes{Status: "ok", Checks: health.Check(r.Context())}
+		code := http.StatusOK
+		// a failing upstream degrades the service, it stays ready for the others
+		if slices.ContainsFunc(res.Checks, func(c CheckStatus) bool { return !c.Healthy && c.Critical }) {
+			res.Status, code = "unavailable", http.StatusServiceUnavailable
+		} else if slices.ContainsFunc(res.Checks, func(c CheckStatus) bool { return !c.Healthy }) {
+			res.Status = "degraded"
 		}
+		switch health.Serving() {
+		case errStarting:
+			res.Status, code = "starting", http.StatusServiceUnavailable
+		case errShuttingDown:
+			res.Status, code = "shutting_down", http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(res)
 	})
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	if admin.Enabled() {
+		mux.Handle("/admin/", admin)
+	}
 
-	lc.Append(fx.Hook{
-		OnStart: func(context.Context) error {
-			go func() {
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					panic(err)
-				}
-			}()
-			return nil
-		},
-		OnStop: func(ctx context.Context) error {
-			isShuttingDown = true
-			return srv.Shutdown(ctx)
-		},
-	})
+	serve(lc, log.With().Str("logger", "o11y").Logger(), addrs, mux, serverTLS.Config)
 
+	return nil
 }
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+//go:embed templates/*.html
+var defaultTemplateFS embed.FS
+
+var defaultTemplates = template.Must(parseDefaultTemplates())
+
+func parseDefaultTemplates() (*template.Template, error) {
+	return template.ParseFS(defaultTemplateFS, "templates/*.html")
+}
+
+// InterstitialParam marks the follow-up request of the signing_in.html page,
+// which performs the login.
+const InterstitialParam = "interstitial"
+
+// ErrorPage is the data of the error.html template.
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	// App is the name of the app the user is signing in to, empty when unknown
+	App     string
+	Title   string
+	Message string
+	// RetryURL repeats the login with the same return_url
+	RetryURL template.URL
+	TraceID  string
+}
+
+// InterstitialPage is the data of the signing_in.html template.
+type InterstitialPage struct {
+	App string
+	// ContinueURL performs the login and redirects to the ReturnURL
+	ContinueURL template.URL
+	ReturnURL   template.URL
+}
+
+// pageTemplates caches the templates of http.template_dir until
+// RunTemplateWatcher sees the configuration or a template change.
+var pageTemplates struct {
+	mu       sync.Mutex
+	dir      string
+	template *template.Template
+}
+
+// templates returns the built-in templates overridden by the *.html files in
+// http.template_dir.
+func templates() (*template.Template, error) {
+	dir := config.Viper().GetString(config.KeyHTTPTemplateDir)
+	if dir == "" {
+		return defaultTemplates, nil
+	}
+
+	pageTemplates.mu.Lock()
+	defer pageTemplates.mu.Unlock()
+
+	if pageTemplates.template != nil && pageTemplates.dir == dir {
+		return pageTemplates.template, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return defaultTemplates, err
+	}
+	t := defaultTemplates
+	if len(files) > 0 {
+		// an executed template cannot be cloned
+		if t, err = parseDefaultTemplates(); err != nil {
+			return nil, err
+		}
+		if t, err = t.ParseFiles(files...); err != nil {
+			// not cached, so that the fixed template is parsed again
+			return nil, err
+		}
+	}
+
+	pageTemplates.dir, pageTemplates.template = dir, t
+	return t, nil
+}
+
+func invalidateTemplates() {
+	pageTemplates.mu.Lock()
+	defer pageTemplates.mu.Unlock()
+
+	pageTemplates.template = nil
+}
+
+type templateWatcher struct {
+	logger  zerolog.Logger
+	watcher *fsnotify.Watcher
+
+	mu  sync.Mutex
+	dir string
+}
+
+// watch replaces the watched template directory.
+func (w *templateWatcher) watch(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if dir == w.dir {
+		return nil
+	}
+	if w.dir != "" {
+		// the directory may be gone already
+		_ = w.watcher.Remove(w.dir)
+	}
+	w.dir = dir
+	if dir == "" {
+		return nil
+	}
+	return w.watcher.Add(dir)
+}
+
+// RunTemplateWatcher empties the template cache when the configuration is
+// reloaded or a file in http.template_dir changes, so that edited templates
+// are picked up without a restart.
+func RunTemplateWatcher(lc fx.Lifecycle) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	w := &templateWatcher{
+		logger:  log.With().Str("logger", "page").Logger(),
+		watcher: watcher,
+	}
+	if err := w.watch(config.Viper().GetString(config.KeyHTTPTemplateDir)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch template directory: %w", err)
+	}
+
+	config.OnReload(func(v *viper.Viper) {
+		invalidateTemplates()
+		if err := w.watch(v.GetString(config.KeyHTTPTemplateDir)); err != nil {
+			w.logger.Error().Err(err).Msg("failed to watch template directory")
+		}
+	})
+
+	done := make(chan struct{})
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+
+				for {
+					select {
+					case e, ok := <-watcher.Events:
+						if !ok {
+							return
+						}
+						w.logger.Debug().Str("file", e.Name).Msg("template changed")
+						invalidateTemplates()
+					case err, ok := <-watcher.Errors:
+						if !ok {
+							return
+						}
+						w.logger.Warn().Err(err).Msg("template watcher error")
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			err := watcher.Close()
+			<-done
+			return err
+		},
+	})
+
+	return nil
+}
+
+// RenderPage renders a template of http.template_dir or a built-in one.
+func RenderPage(c *gin.Context, code int, name string, data any) {
+	t, err := templates()
+	if err != nil {
+		// a broken custom template must not hide the page
+		c.Error(err)
+		t = defaultTemplates
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Render(code, pageRender{template: t, name: name, data: data})
+}
+
+type pageRender struct {
+	template *template.Template
+	name     string
+	data     any
+}
+
+func (r pageRender) Render(w http.ResponseWriter) error {
+	r.WriteContentType(w)
+	return r.template.ExecuteTemplate(w, r.name, r.data)
+}
+
+func (r pageRender) WriteContentType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+}
+
+// retryURL is relative to the path the browser requested, which may differ
+// behind a proxy, and goes through the signing in page again. Being only a
+// query it cannot point anywhere else, e.g. to a javascript: URL.
+func retryURL(u *url.URL) template.URL {
+	q := u.Query()
+	q.Del(InterstitialParam)
+	return template.URL("?" + q.Encode())
+}
+
+// AbortWithErrorPage answers with ErrorRes JSON, or with the error.html page
+// when the client prefers HTML, i.e. a browser following a redirect.
+func AbortWithErrorPage(c *gin.Context, code int, err error, page ErrorPage) {
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) != gin.MIMEHTML {
+		c.AbortWithStatusJSON(code, ErrorRes{Error: err.Error()})
+		return
+	}
+
+	page.Status = code
+	page.StatusText = http.StatusText(code)
+	if page.RetryURL == "" {
+		page.RetryURL = retryURL(c.Request.URL)
+	}
+	if sc := trace.SpanContextFromContext(c); sc.HasTraceID() {
+		page.TraceID = sc.TraceID().String()
+	}
+
+	c.Abort()
+	RenderPage(c, code, "error.html", page)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+func TestRetryURL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  template.URL
+	}{
+		{"", "?"},
+		{"return_url=https://pve.example.com/", "?return_url=https%3A%2F%2Fpve.example.com%2F"},
+		{"return_url=/ghost&interstitial=1", "?return_url=%2Fghost"},
+		{"interstitial=1", "?"},
+		{"return_url=javascript:alert(1)", "?return_url=javascript%3Aalert%281%29"},
+		{`return_url="><script>alert(1)</script>`, "?return_url=%22%3E%3Cscript%3Ealert%281%29%3C%2Fscript%3E"},
+		{"b=2&a=1&a=3", "?a=1&a=3&b=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := retryURL(&url.URL{Path: "/login/proxmox", RawQuery: tt.query}); got != tt.want {
+				t.Errorf("retryURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAbortWithErrorPage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		accept   string
+		page     ErrorPage
+		wantType string
+		want     []string
+	}{
+		{
+			name:     "json",
+			accept:   "application/json",
+			wantType: "application/json",
+			want:     []string{`{"error":"upstream unavailable"}`},
+		},
+		{
+			name:     "browser",
+			accept:   "text/html,application/xhtml+xml,*/*;q=0.8",
+			page:     ErrorPage{App: "Proxmox VE", Title: "Signing in to Proxmox VE failed"},
+			wantType: "text/html",
+			want:     []string{`href="?return_url=javascript%3Aalert%281%29"`, "Signing in to Proxmox VE failed", "502 Bad Gateway"},
+		},
+		{
+			name:     "explicit retry URL",
+			accept:   "text/html",
+			page:     ErrorPage{RetryURL: "/login/ghost"},
+			wantType: "text/html",
+			want:     []string{`href="/login/ghost"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/login/proxmox?return_url=javascript:alert(1)&interstitial=1", nil)
+			c.Request.Header.Set("Accept", tt.accept)
+
+			AbortWithErrorPage(c, http.StatusBadGateway, errors.New("upstream unavailable"), tt.page)
+
+			if w.Code != http.StatusBadGateway || !c.IsAborted() {
+				t.Errorf("status = %d, aborted %v", w.Code, c.IsAborted())
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.wantType)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body does not contain %q:\n%s", want, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplatesCachedUntilChanged(t *testing.T) {
+	dir := t.TempDir()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeyHTTPTemplateDir, dir)
+	t.Cleanup(invalidateTemplates)
+
+	writeTemplate := func(body string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "error.html"), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func() string {
+		t.Helper()
+		tmpl, err := templates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		if err := tmpl.ExecuteTemplate(&b, "error.html", ErrorPage{}); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	writeTemplate("first")
+	lc := fxtest.NewLifecycle(t)
+	if err := RunTemplateWatcher(lc); err != nil {
+		t.Fatal(err)
+	}
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	if got := render(); got != "first" {
+		t.Fatalf("error.html = %q, want the custom template", got)
+	}
+	first, _ := templates()
+	if again, _ := templates(); again != first {
+		t.Error("templates were parsed again without a change")
+	}
+
+	writeTemplate("second")
+	deadline := time.Now().Add(5 * time.Second)
+	for render() != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("the edited template was not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
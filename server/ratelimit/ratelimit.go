@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+)
+
+const (
+	RouteLogin   = "login"
+	RouteSession = "session"
+
+	scopeIP       = "ip"
+	scopeSubject  = "subject"
+	scopeProvider = "provider"
+
+	decisionAllowed = "allowed"
+	decisionLimited = "limited"
+	decisionError   = "error"
+)
+
+var rateKeys = map[string]map[string]string{
+	RouteLogin: {
+		scopeIP:       config.KeyRateLimitLoginIP,
+		scopeSubject:  config.KeyRateLimitLoginSubject,
+		scopeProvider: config.KeyRateLimitLoginProvider,
+	},
+	RouteSession: {
+		scopeIP:       config.KeyRateLimitSessionIP,
+		scopeSubject:  config.KeyRateLimitSessionSubject,
+		scopeProvider: config.KeyRateLimitSessionProvider,
+	},
+}
+
+type Limiter struct {
+	logger    zerolog.Logger
+	store     Store
+	decisions metric.Int64Counter
+}
+
+func NewLimiter(store Store, mp metric.MeterProvider) (*Limiter, error) {
+	decisions, err := mp.Meter(config.AppName).Int64Counter("ratelimit.decisions", metric.WithDescription("Number of rate limiter decisions by route, scope, provider and decision"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Limiter{
+		logger:    log.With().Str("logger", "rateLimiter").Logger(),
+		store:     store,
+		decisions: decisions,
+	}, nil
+}
+
+// Handler limits the requests to a provider's route per client IP, per Ory
+// subject and per provider. A request takes a token from each bucket only
+// when all of them allow it. Requests are let through when the store fails.
+func (l *Limiter) Handler(route, provider string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v := config.Viper()
+
+		scopes := []struct {
+			name, value string
+		}{
+			{scopeIP, c.ClientIP()},
+			{scopeSubject, c.GetHeader(v.GetString(config.KeySubjectHeader))},
+			{scopeProvider, provider},
+		}
+
+		var (
+			limits []Limit
+			names  []string
+		)
+		for _, scope := range scopes {
+			if scope.value == "" {
+				continue
+			}
+			// validated on load, a bad value from a hot reload disables the limit
+			rate, err := config.ParseRate(v.GetString(rateKeys[route][scope.name]))
+			if err != nil || rate.Limit == 0 {
+				continue
+			}
+			limits = append(limits, Limit{Key: route + ":" + scope.name + ":" + scope.value, Rate: rate})
+			names = append(names, scope.name)
+		}
+		if len(limits) == 0 {
+			return
+		}
+
+		attrs := func(scope, decision string) metric.MeasurementOption {
+			return metric.WithAttributes(
+				attribute.String("route", route),
+				attribute.String("scope", scope),
+				attribute.String("provider", provider),
+				attribute.String("decision", decision),
+			)
+		}
+
+		allowed, limited, retryAfter, err := l.store.Take(c, limits)
+		if err != nil {
+			l.logger.Warn().Err(err).Str("route", route).Msg("rate limiter unavailable, letting the request through")
+			for _, name := range names {
+				l.decisions.Add(c, 1, attrs(name, decisionError))
+			}
+			return
+		}
+		if allowed {
+			for _, name := range names {
+				l.decisions.Add(c, 1, attrs(name, decisionAllowed))
+			}
+			return
+		}
+
+		l.decisions.Add(c, 1, attrs(names[limited], decisionLimited))
+		l.logger.Debug().Str("route", route).Str("scope", names[limited]).Str("provider", provider).Dur("retryAfter", retryAfter).Msg("request rate limited")
+
+		c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+		if route != RouteLogin {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, server.ErrorRes{Error: server.ErrRateLimited.Error()})
+			return
+		}
+		server.AbortWithErrorPage(c, http.StatusTooManyRequests, server.ErrRateLimited, server.ErrorPage{
+			App:     config.ProviderNames[provider],
+			Title:   "Too many sign-in attempts",
+			Message: fmt.Sprintf("Please wait %s before signing in to %s again.", max(time.Second, retryAfter.Round(time.Second)), config.ProviderNames[provider]),
+		})
+	}
+}
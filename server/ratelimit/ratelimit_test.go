@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/metric/noop"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+)
+
+func TestHandlerTakesTokensOnlyWhenAllScopesAllow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set(config.KeySubjectHeader, "X-User")
+	viper.Set(config.KeyRateLimitSessionIP, "3/1m")
+	viper.Set(config.KeyRateLimitSessionSubject, "0/1m")
+	viper.Set(config.KeyRateLimitSessionProvider, "1/1m")
+
+	store := NewMemoryStore()
+	l, err := NewLimiter(store, noop.NewMeterProvider())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	e.GET("/session/ghost", l.Handler(RouteSession, config.ProviderGhost), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/ghost", nil))
+		if w.Code != want {
+			t.Errorf("request %d = %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want the provider bucket's 60", w.Header().Get("Retry-After"))
+		}
+	}
+
+	// the requests rejected by the provider bucket left the client IP bucket alone
+	ip := Limit{Key: RouteSession + ":" + scopeIP + ":192.0.2.1", Rate: config.Rate{Limit: 3, Period: time.Minute}}
+	for range 2 {
+		if allowed, _, _, err := store.Take(context.Background(), []Limit{ip}); err != nil || !allowed {
+			t.Fatalf("client IP bucket was used up by rejected requests: %v", err)
+		}
+	}
+}
+
+func TestHandlerKeysOnTrustedProxyHeadersOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type request struct {
+		remoteAddr, forwardedFor, subject string
+		want                              int
+	}
+	tests := []struct {
+		name     string
+		ip       string
+		subject  string
+		requests []request
+	}{
+		{
+			name: "spoofed X-Forwarded-For",
+			ip:   "2/1m",
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.1", want: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.2", want: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1234", forwardedFor: "198.51.100.3", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "X-Forwarded-For of a trusted proxy",
+			ip:   "1/1m",
+			requests: []request{
+				{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.1", want: http.StatusOK},
+				{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.2", want: http.StatusOK},
+				{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.1", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name:    "rotated X-User",
+			ip:      "2/1m",
+			subject: "1/1m",
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1234", subject: "alice", want: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1234", subject: "bob", want: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1234", subject: "carol", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name:    "X-User of another subject",
+			subject: "1/1m",
+			requests: []request{
+				{remoteAddr: "192.0.2.1:1234", subject: "alice", want: http.StatusOK},
+				{remoteAddr: "192.0.2.1:1234", subject: "alice", want: http.StatusOK},
+				// the client did not use up alice's bucket
+				{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.1", subject: "alice", want: http.StatusOK},
+			},
+		},
+		{
+			name:    "X-User of a trusted proxy",
+			ip:      "2/1m",
+			subject: "1/1m",
+			requests: []request{
+				{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.1", subject: "alice", want: http.StatusOK},
+				{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.2", subject: "alice", want: http.StatusTooManyRequests},
+				{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.2", subject: "bob", want: http.StatusOK},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			t.Cleanup(viper.Reset)
+			viper.Set(config.KeySubjectHeader, "X-User")
+			viper.Set(config.KeyRateLimitLoginIP, tt.ip)
+			viper.Set(config.KeyRateLimitLoginSubject, tt.subject)
+
+			l, err := NewLimiter(NewMemoryStore(), noop.NewMeterProvider())
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := gin.New()
+			if err := server.TrustProxies(e, []string{"10.0.0.0/24"}); err != nil {
+				t.Fatal(err)
+			}
+			e.GET("/login/ghost", l.Handler(RouteLogin, config.ProviderGhost), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(http.MethodGet, "/login/ghost", nil)
+				r.RemoteAddr = req.remoteAddr
+				r.Header.Set("Accept", "application/json")
+				if req.forwardedFor != "" {
+					r.Header.Set("X-Forwarded-For", req.forwardedFor)
+				}
+				if req.subject != "" {
+					r.Header.Set("X-User", req.subject)
+				}
+				w := httptest.NewRecorder()
+				e.ServeHTTP(w, r)
+				if w.Code != req.want {
+					t.Errorf("request %d = %d, want %d", i, w.Code, req.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// Limit is a token bucket, identified by key and refilled at rate.
+type Limit struct {
+	Key  string
+	Rate config.Rate
+}
+
+// Store takes a token from every bucket of limits at once, only when each
+// has one left, so that a request rejected by one bucket does not use up the
+// others. Otherwise it returns the index of the bucket that takes the
+// longest to refill and how long until it has a token.
+type Store interface {
+	Take(ctx context.Context, limits []Limit) (allowed bool, limited int, retryAfter time.Duration, err error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	period time.Duration
+}
+
+type memoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (s *memoryStore) Take(_ context.Context, limits []Limit) (bool, int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.prune(now)
+
+	buckets := make([]*bucket, len(limits))
+	limited, retryAfter := -1, time.Duration(0)
+	for i, l := range limits {
+		limit := float64(l.Rate.Limit)
+		b, ok := s.buckets[l.Key]
+		if !ok {
+			b = &bucket{tokens: limit, last: now}
+			s.buckets[l.Key] = b
+		}
+		b.period = l.Rate.Period
+		b.tokens = math.Min(limit, b.tokens+now.Sub(b.last).Seconds()*limit/l.Rate.Period.Seconds())
+		b.last = now
+		buckets[i] = b
+
+		if b.tokens < 1 {
+			if wait := time.Duration((1 - b.tokens) * float64(l.Rate.Period) / limit); limited < 0 || wait > retryAfter {
+				limited, retryAfter = i, wait
+			}
+		}
+	}
+	if limited >= 0 {
+		return false, limited, retryAfter, nil
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, -1, 0, nil
+}
+
+// prune drops buckets that have refilled completely, they are
+// indistinguishable from new ones.
+func (s *memoryStore) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	for key, b := range s.buckets {
+		if now.Sub(b.last) >= b.period {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// the buckets are updated atomically with the server clock so that replicas
+// with skewed clocks share them correctly, ARGV holds the limit and period
+// in milliseconds of each key
+var takeScript = rueidis.NewLuaScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local tokens = {}
+local limited, wait = 0, 0
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[2 * i - 1])
+	local period = tonumber(ARGV[2 * i])
+
+	local bucket = redis.call('HMGET', key, 'tokens', 'ts')
+	local t = tonumber(bucket[1]) or limit
+	local ts = tonumber(bucket[2]) or now
+	tokens[i] = math.min(limit, t + (now - ts) * limit / period)
+
+	if tokens[i] < 1 then
+		local w = math.ceil((1 - tokens[i]) * period / limit)
+		if limited == 0 or w > wait then
+			limited, wait = i, w
+		end
+	end
+end
+
+for i, key in ipairs(KEYS) do
+	if limited == 0 then
+		tokens[i] = tokens[i] - 1
+	end
+	redis.call('HSET', key, 'tokens', tostring(tokens[i]), 'ts', tostring(now))
+	redis.call('PEXPIRE', key, tonumber(ARGV[2 * i]))
+end
+return {limited, wait}
+`)
+
+type redisStore struct {
+	client rueidis.Client
+	prefix string
+}
+
+func NewRedisStore(client rueidis.Client) Store {
+	return &redisStore{
+		client: client,
+		// the hash tag keeps the buckets of a request in one Redis Cluster slot
+		prefix: "{" + config.AppName + ":ratelimit}:",
+	}
+}
+
+func (s *redisStore) Take(ctx context.Context, limits []Limit) (bool, int, time.Duration, error) {
+	keys := make([]string, 0, len(limits))
+	args := make([]string, 0, 2*len(limits))
+	for _, l := range limits {
+		keys = append(keys, s.prefix+l.Key)
+		args = append(args, strconv.Itoa(l.Rate.Limit), strconv.FormatInt(l.Rate.Period.Milliseconds(), 10))
+	}
+
+	res, err := takeScript.Exec(ctx, s.client, keys, args).AsIntSlice()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	// the script counts from 1, 0 when every bucket had a token
+	return res[0] == 0, int(res[0]) - 1, time.Duration(res[1]) * time.Millisecond, nil
+}
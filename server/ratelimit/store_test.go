@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/rueidis"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+type testStore struct {
+	Store
+	advance func(d time.Duration)
+}
+
+func newTestStores(t *testing.T) map[string]func() testStore {
+	return map[string]func() testStore{
+		"memory": func() testStore {
+			now := time.Now()
+			s := NewMemoryStore().(*memoryStore)
+			s.now = func() time.Time { return now }
+			return testStore{Store: s, advance: func(d time.Duration) { now = now.Add(d) }}
+		},
+		"redis": func() testStore {
+			m := miniredis.RunT(t)
+			now := time.Now().Truncate(time.Millisecond)
+			m.SetTime(now)
+
+			client, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{m.Addr()}, DisableCache: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(client.Close)
+
+			return testStore{Store: NewRedisStore(client), advance: func(d time.Duration) {
+				now = now.Add(d)
+				m.SetTime(now)
+				m.FastForward(d)
+			}}
+		},
+	}
+}
+
+type take struct {
+	advance    time.Duration
+	keys       []string
+	allowed    bool
+	limited    int
+	retryAfter time.Duration
+}
+
+func TestStoreTake(t *testing.T) {
+	rates := map[string]config.Rate{
+		"three": {Limit: 3, Period: time.Minute},
+		"two":   {Limit: 2, Period: time.Minute},
+		"one":   {Limit: 1, Period: time.Minute},
+		"hour":  {Limit: 1, Period: time.Hour},
+	}
+
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{
+			name: "bucket empties and refills at the rate",
+			takes: []take{
+				{keys: []string{"three"}, allowed: true, limited: -1},
+				{keys: []string{"three"}, allowed: true, limited: -1},
+				{keys: []string{"three"}, allowed: true, limited: -1},
+				{keys: []string{"three"}, limited: 0, retryAfter: 20 * time.Second},
+				{advance: 10 * time.Second, keys: []string{"three"}, limited: 0, retryAfter: 10 * time.Second},
+				{advance: 10 * time.Second, keys: []string{"three"}, allowed: true, limited: -1},
+				{keys: []string{"three"}, limited: 0, retryAfter: 20 * time.Second},
+			},
+		},
+		{
+			name: "refill is capped at the limit",
+			takes: []take{
+				{keys: []string{"two"}, allowed: true, limited: -1},
+				{advance: time.Hour, keys: []string{"two"}, allowed: true, limited: -1},
+				{keys: []string{"two"}, allowed: true, limited: -1},
+				{keys: []string{"two"}, limited: 0, retryAfter: 30 * time.Second},
+			},
+		},
+		{
+			name: "a rejected request takes no token",
+			takes: []take{
+				{keys: []string{"two", "one"}, allowed: true, limited: -1},
+				{keys: []string{"two", "one"}, limited: 1, retryAfter: time.Minute},
+				{keys: []string{"two", "one"}, limited: 1, retryAfter: time.Minute},
+				// the first request took the only token of two that was used
+				{keys: []string{"two"}, allowed: true, limited: -1},
+				{keys: []string{"two"}, limited: 0, retryAfter: 30 * time.Second},
+			},
+		},
+		{
+			name: "longest wait is reported",
+			takes: []take{
+				{keys: []string{"one", "hour"}, allowed: true, limited: -1},
+				{keys: []string{"one", "hour"}, limited: 1, retryAfter: time.Hour},
+				{advance: time.Minute, keys: []string{"one", "hour"}, limited: 1, retryAfter: 59 * time.Minute},
+				{keys: []string{"one"}, allowed: true, limited: -1},
+			},
+		},
+	}
+
+	for name, newStore := range newTestStores(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				s := newStore()
+				for i, step := range tt.takes {
+					s.advance(step.advance)
+
+					limits := make([]Limit, 0, len(step.keys))
+					for _, key := range step.keys {
+						limits = append(limits, Limit{Key: key, Rate: rates[key]})
+					}
+					allowed, limited, retryAfter, err := s.Take(context.Background(), limits)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if allowed != step.allowed || limited != step.limited || retryAfter != step.retryAfter {
+						t.Errorf("take %d = %v, %d, %s, want %v, %d, %s", i, allowed, limited, retryAfter, step.allowed, step.limited, step.retryAfter)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryStore().(*memoryStore)
+	s.now = func() time.Time { return now }
+
+	rate := config.Rate{Limit: 1, Period: 30 * time.Second}
+	for _, key := range []string{"a", "b"} {
+		if _, _, _, err := s.Take(context.Background(), []Limit{{Key: key, Rate: rate}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+	if allowed, _, _, _ := s.Take(context.Background(), []Limit{{Key: "a", Rate: rate}}); !allowed {
+		t.Error("refilled bucket is limited")
+	}
+	if _, ok := s.buckets["b"]; ok || len(s.buckets) != 1 {
+		t.Errorf("buckets = %v, want the refilled bucket b pruned", s.buckets)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// RegisterDrain marks the service ready once every component has started.
+// It must be invoked last so that on shutdown, when hooks run in reverse
+// order, it marks the service not ready and waits for the drain delay
+// before the HTTP servers stop, giving Kubernetes and Oathkeeper time to
+// stop sending requests.
+func RegisterDrain(lc fx.Lifecycle, health *Health) {
+	logger := log.With().Str("logger", "shutdown").Logger()
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			health.state.Store(stateServing)
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			health.state.Store(stateDraining)
+
+			delay := config.Viper().GetDuration(config.KeyShutdownDrainDelay)
+			logger.Info().Str("delay", delay.String()).Msg("marked not ready, draining")
+			select {
+			case <-time.After(delay):
+				logger.Info().Msg("drain delay passed, stopping")
+			case <-ctx.Done():
+				logger.Warn().Msg("shutdown timeout reached while draining, stopping")
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// certificateReloader serves the certificate and client CAs last read from
+// their files, which are read again whenever their directory changes.
+type certificateReloader struct {
+	logger       zerolog.Logger
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	certificate atomic.Pointer[tls.Certificate]
+	clientCAs   atomic.Pointer[x509.CertPool]
+}
+
+func (r *certificateReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", r.clientCAFile)
+		}
+	}
+
+	r.certificate.Store(&cert)
+	r.clientCAs.Store(pool)
+	return nil
+}
+
+func (r *certificateReloader) watch(lc fx.Lifecycle) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Kubernetes and cert-manager rotate mounted certificates by swapping a
+	// symlink in the parent directory, so the directory is watched instead.
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if file == "" {
+			continue
+		}
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch certificate directory %s: %w", filepath.Dir(file), err)
+		}
+	}
+
+	done := make(chan struct{})
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+
+				for {
+					select {
+					case _, ok := <-watcher.Events:
+						if !ok {
+							return
+						}
+						// the certificate and key are written separately, a
+						// mismatched pair is retried on the next event
+						if err := r.load(); err != nil {
+							r.logger.Warn().Err(err).Msg("failed to reload TLS certificate, keeping previous one")
+							continue
+						}
+						r.logger.Debug().Msg("TLS certificate reloaded")
+					case err, ok := <-watcher.Errors:
+						if !ok {
+							return
+						}
+						r.logger.Warn().Err(err).Msg("TLS certificate watcher error")
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			err := watcher.Close()
+			<-done
+			return err
+		},
+	})
+	return nil
+}
+
+// ServerTLS is the TLS configuration of the listeners serving TLS, Config is
+// nil when there is no certificate and every listener serves plain HTTP.
+type ServerTLS struct {
+	Config *tls.Config
+}
+
+func NewServerTLS(lc fx.Lifecycle, mp metric.MeterProvider) (*ServerTLS, error) {
+	if viper.GetString(config.KeyHTTPTLSCertFile) == "" {
+		return &ServerTLS{}, nil
+	}
+
+	r := &certificateReloader{
+		logger:       log.With().Str("logger", "tls").Logger(),
+		certFile:     viper.GetString(config.KeyHTTPTLSCertFile),
+		keyFile:      viper.GetString(config.KeyHTTPTLSKeyFile),
+		clientCAFile: viper.GetString(config.KeyHTTPTLSClientCAFile),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	if err := r.watch(lc); err != nil {
+		return nil, err
+	}
+
+	if _, err := mp.Meter(config.AppName).Int64ObservableGauge("http.tls.certificate.expiry",
+		metric.WithDescription("Unix time at which the HTTP server TLS certificate expires"),
+		metric.WithUnit("s"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			if leaf, err := x509.ParseCertificate(r.certificate.Load().Certificate[0]); err == nil {
+				o.Observe(leaf.NotAfter.Unix(), metric.WithAttributes(attribute.String("subject", leaf.Subject.CommonName)))
+			}
+			return nil
+		}),
+	); err != nil {
+		return nil, err
+	}
+
+	minVersion, ok := config.TLSVersions[viper.GetString(config.KeyHTTPTLSMinVersion)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q", viper.GetString(config.KeyHTTPTLSMinVersion))
+	}
+
+	return &ServerTLS{Config: &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := &tls.Config{
+				MinVersion:   minVersion,
+				NextProtos:   []string{"h2", "http/1.1"},
+				Certificates: []tls.Certificate{*r.certificate.Load()},
+			}
+			// browsers on /login have no client certificate, it is
+			// enforced per route by RequireClientCertificate
+			if pool := r.clientCAs.Load(); pool != nil {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return c, nil
+		},
+	}}, nil
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// clientCertificateAllowed reports whether the request has a verified client
+// certificate naming one of the allowed subjects.
+func clientCertificateAllowed(r *http.Request, allowed []string) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	return slices.ContainsFunc(certificateNames(r.TLS.VerifiedChains[0][0]), func(name string) bool {
+		return slices.Contains(allowed, name)
+	})
+}
+
+// RequireClientCertificate rejects requests without a verified client
+// certificate when client certificates are verified, and those whose
+// certificate names none of the allowed subjects.
+func RequireClientCertificate() gin.HandlerFunc {
+	enabled := viper.GetString(config.KeyHTTPTLSClientCAFile) != ""
+
+	return func(c *gin.Context) {
+		if !enabled {
+			return
+		}
+		// the socket file permissions guard who may connect
+		if addr, ok := ListenAddressFromContext(c.Request.Context()); ok && addr.Network == config.ListenNetworkUnix {
+			return
+		}
+
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorRes{Error: ErrClientCertificateRequired.Error()})
+			return
+		}
+
+		allowed := config.Viper().GetStringSlice(config.KeyHTTPTLSClientSubjects)
+		if len(allowed) > 0 && !clientCertificateAllowed(c.Request, allowed) {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorRes{Error: ErrClientCertificateNotAllowed.Error()})
+			return
+		}
+	}
+}
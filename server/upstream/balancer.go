@@ -0,0 +1,217 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+var ProbePaths = map[string]string{
+	config.ProviderProxmox: "/api2/extjs/version",
+	config.ProviderArgoCD:  "/api/version",
+	config.ProviderGhost:   "/ghost/api/admin/site/",
+	config.ProviderN8N:     "/healthz",
+	config.ProviderNocoDB:  "/api/v1/health",
+}
+
+type endpoint struct {
+	url     *url.URL
+	healthy atomic.Bool
+}
+
+// balancer rewrites requests made against the primary server URL to one of
+// the configured endpoints, skipping endpoints that recently failed.
+type balancer struct {
+	logger     zerolog.Logger
+	provider   string
+	primary    string
+	endpoints  []*endpoint
+	roundRobin bool
+	next       atomic.Uint64
+	transport  http.RoundTripper
+}
+
+func newBalancer(logger zerolog.Logger, provider string, urls []string, roundRobin bool, previous *balancer, transport http.RoundTripper) (*balancer, error) {
+	b := &balancer{
+		logger:     logger,
+		provider:   provider,
+		roundRobin: roundRobin,
+		transport:  transport,
+	}
+
+	for _, s := range urls {
+		u, err := url.Parse(strings.TrimRight(s, "/"))
+		if err != nil {
+			return nil, err
+		}
+		e := &endpoint{url: u}
+		e.healthy.Store(true)
+		// keep the health of endpoints that survive a config reload
+		if previous != nil {
+			for _, p := range previous.endpoints {
+				if p.url.String() == u.String() {
+					e.healthy.Store(p.healthy.Load())
+				}
+			}
+		}
+		b.endpoints = append(b.endpoints, e)
+	}
+	if len(b.endpoints) > 0 {
+		b.primary = b.endpoints[0].url.String()
+	}
+
+	return b, nil
+}
+
+func (b *balancer) candidates() []*endpoint {
+	n := len(b.endpoints)
+	start := 0
+	if b.roundRobin && n > 0 {
+		start = int(b.next.Add(1)-1) % n
+	}
+
+	var healthy, unhealthy []*endpoint
+	for i := range n {
+		e := b.endpoints[(start+i)%n]
+		if e.healthy.Load() {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	// unhealthy endpoints are still tried last rather than failing outright
+	return append(healthy, unhealthy...)
+}
+
+func (b *balancer) setHealthy(e *endpoint, healthy bool) {
+	if e.healthy.Swap(healthy) != healthy {
+		b.logger.Warn().Str("provider", b.provider).Str("endpoint", e.url.String()).Bool("healthy", healthy).Msg("upstream endpoint health changed")
+	}
+}
+
+func rewrite(req *http.Request, primary string, e *endpoint) *http.Request {
+	target := e.url.String() + strings.TrimPrefix(req.URL.String(), primary)
+	u, err := url.Parse(target)
+	if err != nil {
+		return req
+	}
+
+	r := req.Clone(req.Context())
+	r.URL = u
+	r.Host = ""
+	return r
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isGatewayError reports whether a proxy in front of an endpoint answered
+// for it, e.g. because the app behind it is down or restarting.
+func isGatewayError(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func (b *balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(b.endpoints) < 2 || !strings.HasPrefix(req.URL.String(), b.primary) {
+		return b.transport.RoundTrip(req)
+	}
+
+	var (
+		res *http.Response
+		err error
+	)
+	candidates := b.candidates()
+	for i, e := range candidates {
+		r := rewrite(req, b.primary, e)
+		if i > 0 && req.Body != nil && req.GetBody != nil {
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err = b.transport.RoundTrip(r)
+		// any other answer comes from the app, errors included, and says
+		// nothing about whether the endpoint can serve requests
+		if err == nil && !isGatewayError(res.StatusCode) {
+			b.setHealthy(e, true)
+			return res, nil
+		}
+		if req.Context().Err() != nil {
+			return res, err
+		}
+		b.setHealthy(e, false)
+
+		if i == len(candidates)-1 || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+		switch {
+		// the request never reached the endpoint, so it is safe to try the next
+		// one whatever the method
+		case err != nil && isDialError(err):
+		// the endpoint is down behind a proxy, an idempotent request may be
+		// repeated, others are not as the app may have handled them already
+		case err == nil && isGatewayError(res.StatusCode) && isIdempotent(req.Method):
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		default:
+			return res, err
+		}
+	}
+	return res, err
+}
+
+func (b *balancer) probe(ctx context.Context, timeout time.Duration) {
+	path, ok := ProbePaths[b.provider]
+	if !ok || len(b.endpoints) < 2 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, e := range b.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url.String()+path, nil)
+			if err != nil {
+				return
+			}
+			res, err := b.transport.RoundTrip(req)
+			if err != nil {
+				b.setHealthy(e, false)
+				return
+			}
+			res.Body.Close()
+			b.setHealthy(e, !isGatewayError(res.StatusCode))
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestBalancerFailover(t *testing.T) {
+	tests := []struct {
+		name        string
+		first       int // 0 when the first endpoint refuses connections
+		method      string
+		wantCode    int
+		wantSecond  bool
+		wantHealthy bool
+	}{
+		{"healthy", http.StatusOK, http.MethodGet, http.StatusOK, false, true},
+		{"client error is the app's answer", http.StatusUnauthorized, http.MethodGet, http.StatusUnauthorized, false, true},
+		{"connection refused", 0, http.MethodPost, http.StatusOK, true, false},
+		{"bad gateway", http.StatusBadGateway, http.MethodGet, http.StatusOK, true, false},
+		{"service unavailable", http.StatusServiceUnavailable, http.MethodHead, http.StatusOK, true, false},
+		{"gateway timeout", http.StatusGatewayTimeout, http.MethodGet, http.StatusOK, true, false},
+		{"internal server error is the app's answer", http.StatusInternalServerError, http.MethodGet, http.StatusInternalServerError, false, true},
+		{"bad gateway on a login is not repeated", http.StatusBadGateway, http.MethodPost, http.StatusBadGateway, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tt.first)
+			}))
+			if tt.first == 0 {
+				first.Close()
+			} else {
+				defer first.Close()
+			}
+			var secondRequests atomic.Int32
+			second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				secondRequests.Add(1)
+				if b, _ := io.ReadAll(r.Body); r.Method == http.MethodPost && string(b) != "body" {
+					t.Errorf("second endpoint got body %q", b)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer second.Close()
+
+			b, err := newBalancer(zerolog.Nop(), "test", []string{first.URL, second.URL}, false, nil, http.DefaultTransport)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(tt.method, first.URL+"/api", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := b.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantCode || (secondRequests.Load() > 0) != tt.wantSecond {
+				t.Errorf("got %d after %d requests to the second endpoint, want %d, second %v", res.StatusCode, secondRequests.Load(), tt.wantCode, tt.wantSecond)
+			}
+			if healthy := b.endpoints[0].healthy.Load(); healthy != tt.wantHealthy {
+				t.Errorf("first endpoint healthy = %v, want %v", healthy, tt.wantHealthy)
+			}
+		})
+	}
+}
+
+func TestBalancerLastEndpointAnswers(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("maintenance"))
+	}))
+	defer srv.Close()
+
+	b, err := newBalancer(zerolog.Nop(), "test", []string{srv.URL, srv.URL + "/"}, false, nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api", nil)
+	res, err := b.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable || string(body) != "maintenance" || requests.Load() != 2 {
+		t.Errorf("got %d %q, %v after %d requests, want the last endpoint's answer", res.StatusCode, body, err, requests.Load())
+	}
+}
+
+func TestBalancerKeepsEndpointOnApplicationError(t *testing.T) {
+	var firstRequests, secondRequests atomic.Int32
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		firstRequests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		secondRequests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer second.Close()
+
+	b, err := newBalancer(zerolog.Nop(), "test", []string{first.URL, second.URL}, false, nil, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		req, _ := http.NewRequest(http.MethodGet, first.URL+"/api", nil)
+		res, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	if firstRequests.Load() != 3 || secondRequests.Load() != 0 {
+		t.Errorf("first endpoint got %d requests and second %d, want every request to stay on the first", firstRequests.Load(), secondRequests.Load())
+	}
+}
@@ -0,0 +1,162 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "open"
+	}
+}
+
+// Breaker opens after a number of consecutive failures and rejects requests
+// until the open duration has passed, then lets a single trial request
+// through to decide whether to close again.
+type Breaker struct {
+	logger   zerolog.Logger
+	provider string
+
+	mu           sync.Mutex
+	state        BreakerState
+	failures     int
+	openUntil    time.Time
+	trial        bool
+	threshold    int
+	openDuration time.Duration
+}
+
+func newBreaker(logger zerolog.Logger, provider string) *Breaker {
+	return &Breaker{
+		logger:   logger,
+		provider: provider,
+	}
+}
+
+func (b *Breaker) configure(threshold int, openDuration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.threshold, b.openDuration = threshold, openDuration
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	b.logger.Warn().Str("provider", b.provider).Str("from", b.state.String()).Str("to", state.String()).Msg("circuit breaker state changed")
+	b.state = state
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Now().After(b.openUntil) {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Remaining returns how long the breaker stays open before a trial request.
+func (b *Breaker) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerOpen {
+		return 0
+	}
+	return max(time.Until(b.openUntil), 0)
+}
+
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return true
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+func (b *Breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.openUntil = time.Now().Add(b.openDuration)
+		b.setState(BreakerOpen)
+	}
+}
+
+type breakerTransport struct {
+	breaker *Breaker
+	next    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// cancelled by the caller, says nothing about the upstream
+		t.breaker.release()
+		return res, err
+	}
+	t.breaker.record(err != nil || res.StatusCode >= http.StatusInternalServerError)
+	return res, err
+}
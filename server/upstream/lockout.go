@@ -0,0 +1,138 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrCredentialsLocked = errors.New("logins suspended after the upstream rejected the credentials")
+
+// Lockout suspends logins of a provider account after the upstream rejected
+// its credentials a number of times in a row, so that repeated attempts with
+// a wrong password do not get the shared account locked or throttled. After
+// the first rejection a single trial login at a time is let through, and
+// none during the cool-down, which doubles every time a trial is rejected
+// again. New credentials lift the lockout.
+type Lockout struct {
+	logger   zerolog.Logger
+	provider string
+
+	mu          sync.Mutex
+	rejections  int
+	cooldown    time.Duration
+	until       time.Time
+	trial       bool
+	credentials [sha256.Size]byte
+	threshold   int
+	minCooldown time.Duration
+	maxCooldown time.Duration
+	now         func() time.Time
+}
+
+func newLockout(logger zerolog.Logger, provider string) *Lockout {
+	return &Lockout{
+		logger:   logger,
+		provider: provider,
+		now:      time.Now,
+	}
+}
+
+func (l *Lockout) configure(threshold int, cooldown, maxCooldown time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.threshold, l.minCooldown, l.maxCooldown = threshold, cooldown, maxCooldown
+}
+
+func (l *Lockout) reset() {
+	l.rejections, l.cooldown, l.until, l.trial = 0, 0, time.Time{}, false
+}
+
+// Allow reports whether a login with the given credentials may be attempted,
+// otherwise how long until the next one may. Every allowed login must be
+// followed by Accepted, Rejected or Release.
+func (l *Lockout) Allow(username, password string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.threshold <= 0 {
+		return true, 0
+	}
+
+	credentials := sha256.Sum256([]byte(username + "\x00" + password))
+	if credentials != l.credentials {
+		if l.rejections >= l.threshold {
+			l.logger.Info().Str("provider", l.provider).Msg("credentials changed, resuming logins")
+		}
+		l.reset()
+		l.credentials = credentials
+	}
+
+	if l.rejections == 0 {
+		return true, 0
+	}
+	if l.rejections >= l.threshold {
+		if remaining := l.until.Sub(l.now()); remaining > 0 {
+			return false, remaining
+		}
+	}
+	if l.trial {
+		// the verdict of the trial login is pending
+		return false, time.Second
+	}
+	l.trial = true
+	return true, 0
+}
+
+func (l *Lockout) Accepted() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rejections >= l.threshold && l.threshold > 0 {
+		l.logger.Info().Str("provider", l.provider).Msg("credentials accepted again, resuming logins")
+	}
+	l.reset()
+}
+
+func (l *Lockout) Rejected() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.trial = false
+	l.rejections++
+	if l.threshold <= 0 || l.rejections < l.threshold {
+		return
+	}
+
+	if l.cooldown == 0 {
+		l.cooldown = l.minCooldown
+	} else {
+		l.cooldown = min(2*l.cooldown, l.maxCooldown)
+	}
+	l.until = l.now().Add(l.cooldown)
+	l.logger.Error().Str("provider", l.provider).Int("rejections", l.rejections).Dur("cooldown", l.cooldown).Msg("upstream rejected the credentials, logins suspended")
+}
+
+// Release ends a login that got no verdict on the credentials, e.g. because
+// the upstream was unreachable.
+func (l *Lockout) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.trial = false
+}
+
+// Remaining returns how long logins stay suspended.
+func (l *Lockout) Remaining() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.threshold <= 0 || l.rejections < l.threshold {
+		return 0
+	}
+	return max(l.until.Sub(l.now()), 0)
+}
@@ -0,0 +1,183 @@
+package upstream
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type lockoutStep struct {
+	action string // allow, reject, accept, release or advance
+	creds  string
+	d      time.Duration
+
+	allowed   bool
+	wait      time.Duration
+	remaining time.Duration
+}
+
+func TestLockout(t *testing.T) {
+	allow := func(creds string, allowed bool, wait time.Duration) lockoutStep {
+		return lockoutStep{action: "allow", creds: creds, allowed: allowed, wait: wait}
+	}
+	reject := func(remaining time.Duration) lockoutStep {
+		return lockoutStep{action: "reject", remaining: remaining}
+	}
+	advance := func(d time.Duration) lockoutStep {
+		return lockoutStep{action: "advance", d: d}
+	}
+	accept := lockoutStep{action: "accept"}
+	release := lockoutStep{action: "release"}
+
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []lockoutStep
+	}{
+		{
+			name:      "disabled",
+			threshold: 0,
+			steps: []lockoutStep{
+				allow("a", true, 0), reject(0),
+				allow("a", true, 0), reject(0),
+				allow("a", true, 0),
+			},
+		},
+		{
+			name:      "suspends at the threshold",
+			threshold: 2,
+			steps: []lockoutStep{
+				allow("a", true, 0), reject(0),
+				allow("a", true, 0), reject(time.Minute),
+				allow("a", false, time.Minute),
+				advance(20 * time.Second),
+				allow("a", false, 40*time.Second),
+			},
+		},
+		{
+			name:      "one login at a time after a rejection",
+			threshold: 3,
+			steps: []lockoutStep{
+				allow("a", true, 0), allow("a", true, 0), reject(0),
+				allow("a", true, 0),
+				allow("a", false, time.Second),
+				reject(0),
+				allow("a", true, 0),
+				release,
+				allow("a", true, 0),
+			},
+		},
+		{
+			name:      "acceptance below the threshold starts over",
+			threshold: 2,
+			steps: []lockoutStep{
+				allow("a", true, 0), reject(0),
+				allow("a", true, 0), accept,
+				allow("a", true, 0), reject(0),
+				allow("a", true, 0),
+			},
+		},
+		{
+			name:      "single trial login after the cool-down",
+			threshold: 1,
+			steps: []lockoutStep{
+				allow("a", true, 0), reject(time.Minute),
+				advance(time.Minute),
+				allow("a", true, 0),
+				// the verdict of the trial is pending
+				allow("a", false, time.Second),
+				release,
+				allow("a", true, 0), accept,
+				allow("a", true, 0), allow("a", true, 0),
+			},
+		},
+		{
+			name:      "cool-down doubles up to the maximum",
+			threshold: 1,
+			steps: []lockoutStep{
+				allow("a", true, 0), reject(time.Minute),
+				advance(time.Minute), allow("a", true, 0), reject(2 * time.Minute),
+				advance(2 * time.Minute), allow("a", true, 0), reject(4 * time.Minute),
+				advance(4 * time.Minute), allow("a", true, 0), reject(5 * time.Minute),
+				advance(5 * time.Minute), allow("a", true, 0), reject(5 * time.Minute),
+			},
+		},
+		{
+			name:      "new credentials lift the lockout",
+			threshold: 1,
+			steps: []lockoutStep{
+				allow("a", true, 0), reject(time.Minute),
+				allow("b", true, 0), reject(time.Minute),
+				allow("b", false, time.Minute),
+				allow("a", true, 0),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			l := newLockout(zerolog.Nop(), "test")
+			l.now = func() time.Time { return now }
+			l.configure(tt.threshold, time.Minute, 5*time.Minute)
+
+			for i, step := range tt.steps {
+				switch step.action {
+				case "allow":
+					allowed, wait := l.Allow("admin", step.creds)
+					if allowed != step.allowed || wait != step.wait {
+						t.Errorf("step %d: Allow() = %v, %s, want %v, %s", i, allowed, wait, step.allowed, step.wait)
+					}
+				case "reject":
+					l.Rejected()
+					if remaining := l.Remaining(); remaining != step.remaining {
+						t.Errorf("step %d: Remaining() = %s, want %s", i, remaining, step.remaining)
+					}
+				case "accept":
+					l.Accepted()
+					if remaining := l.Remaining(); remaining != 0 {
+						t.Errorf("step %d: Remaining() = %s after an accepted login", i, remaining)
+					}
+				case "release":
+					l.Release()
+				case "advance":
+					now = now.Add(step.d)
+				}
+			}
+		})
+	}
+}
+
+func TestLockoutConcurrentLogins(t *testing.T) {
+	l := newLockout(zerolog.Nop(), "test")
+	l.configure(3, time.Minute, 5*time.Minute)
+	if allowed, _ := l.Allow("admin", "a"); !allowed {
+		t.Fatal("first login was not allowed")
+	}
+	l.Rejected()
+
+	for round := range 3 {
+		var (
+			allowed atomic.Int32
+			wg      sync.WaitGroup
+		)
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, _ := l.Allow("admin", "a"); ok {
+					allowed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := allowed.Load(); n != 1 {
+			t.Errorf("round %d: %d concurrent logins were let through after a rejection, want 1", round, n)
+		}
+		l.Release()
+	}
+}
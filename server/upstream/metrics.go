@@ -0,0 +1,37 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type metricsTransport struct {
+	provider string
+	duration metric.Float64Histogram
+	next     http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+
+	outcome := "error"
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		outcome = "circuit_open"
+	case err == nil:
+		outcome = strconv.Itoa(res.StatusCode)
+	}
+
+	t.duration.Record(req.Context(), time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("provider", t.provider),
+		attribute.String("method", req.Method),
+		attribute.String("outcome", outcome),
+	))
+	return res, err
+}
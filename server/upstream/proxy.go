@@ -0,0 +1,51 @@
+package upstream
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+// newProxyFunc returns the proxy selection of a provider for http.Transport,
+// which speaks HTTP CONNECT as well as SOCKS5. Without a proxy url the proxy
+// environment variables apply as before.
+func newProxyFunc(v *viper.Viper, provider string) func(*http.Request) (*url.URL, error) {
+	raw := v.GetString(config.ProviderKey(provider, config.KeySuffixProxyURL))
+	if raw == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	match := (&httpproxy.Config{
+		HTTPProxy:  raw,
+		HTTPSProxy: raw,
+		NoProxy:    strings.Join(v.GetStringSlice(config.ProviderKey(provider, config.KeySuffixProxyNoProxy)), ","),
+	}).ProxyFunc()
+
+	usernameKey := config.ProviderKey(provider, config.KeySuffixProxyUsername)
+	passwordKey := config.ProviderKey(provider, config.KeySuffixProxyPassword)
+
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := match(req.URL)
+		if err != nil || u == nil {
+			return nil, err
+		}
+
+		// credentials are looked up per request to pick up rotated secrets
+		proxyURL := *u
+		username, err := config.Secret(usernameKey)
+		if err != nil || username == "" {
+			return &proxyURL, err
+		}
+		password, err := config.Secret(passwordKey)
+		if err != nil {
+			return nil, err
+		}
+		proxyURL.User = url.UserPassword(username, password)
+		return &proxyURL, nil
+	}
+}
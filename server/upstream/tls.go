@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+)
+
+func newTLSConfig(v *viper.Viper, provider string, observe func(kind string, cert *x509.Certificate)) (*tls.Config, error) {
+	minVersion, ok := config.TLSVersions[v.GetString(config.ProviderKey(provider, config.KeySuffixTLSMinVersion))]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported TLS version %q", provider, v.GetString(config.ProviderKey(provider, config.KeySuffixTLSMinVersion)))
+	}
+
+	c := &tls.Config{
+		MinVersion:         minVersion,
+		ServerName:         v.GetString(config.ProviderKey(provider, config.KeySuffixTLSServerName)),
+		InsecureSkipVerify: v.GetBool(config.ProviderKey(provider, config.KeySuffixTLSInsecureSkipVerify)),
+		// runs for every handshake, including skipped verification, to track the upstream certificate expiry
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) > 0 {
+				observe(certificateServer, cs.PeerCertificates[0])
+			}
+			return nil
+		},
+	}
+
+	if caFile := v.GetString(config.ProviderKey(provider, config.KeySuffixTLSCAFile)); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", provider, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found in %s", provider, caFile)
+		}
+		c.RootCAs = pool
+	}
+
+	certFile := v.GetString(config.ProviderKey(provider, config.KeySuffixTLSCertFile))
+	keyFile := v.GetString(config.ProviderKey(provider, config.KeySuffixTLSKeyFile))
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", provider, err)
+		}
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			observe(certificateClient, leaf)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,398 @@
+package upstream
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+)
+
+const (
+	certificateServer = "server"
+	certificateClient = "client"
+)
+
+type certificateKey struct {
+	provider string
+	kind     string
+}
+
+type Registry struct {
+	logger   zerolog.Logger
+	breakers map[string]*Breaker
+	lockouts map[string]*Lockout
+	duration metric.Float64Histogram
+
+	mu         sync.RWMutex
+	clients    map[string]*resty.Client
+	probes     map[string]*http.Client
+	balancers  map[string]*balancer
+	transports []*http.Transport
+
+	certMu       sync.Mutex
+	certificates map[certificateKey]*x509.Certificate
+}
+
+func NewRegistry(lc fx.Lifecycle, mp metric.MeterProvider, health *server.Health) (*Registry, error) {
+	r := &Registry{
+		logger:       log.With().Str("logger", "upstream").Logger(),
+		breakers:     make(map[string]*Breaker, len(config.AllProviders)),
+		lockouts:     make(map[string]*Lockout, len(config.AllProviders)),
+		certificates: make(map[certificateKey]*x509.Certificate),
+	}
+	var err error
+	if r.duration, err = mp.Meter(config.AppName).Float64Histogram("upstream.request.duration",
+		metric.WithDescription("Duration of upstream request attempts by provider, method and outcome"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+
+	for _, provider := range config.AllProviders {
+		b := newBreaker(r.logger, provider)
+		r.breakers[provider] = b
+		health.Register("upstream."+provider+".circuit_breaker", false, func(context.Context) error {
+			if b.State() == BreakerOpen {
+				return ErrCircuitOpen
+			}
+			return nil
+		})
+
+		l := newLockout(r.logger, provider)
+		r.lockouts[provider] = l
+		health.Register("upstream."+provider+".credentials", false, func(context.Context) error {
+			if remaining := l.Remaining(); remaining > 0 {
+				return fmt.Errorf("%w, retrying in %s", ErrCredentialsLocked, remaining.Round(time.Second))
+			}
+			return nil
+		})
+	}
+
+	for _, provider := range config.AllProviders {
+		health.RegisterProbe("upstream."+provider, false, func(ctx context.Context) error {
+			return r.probe(ctx, provider)
+		})
+	}
+
+	if err := r.build(config.Viper()); err != nil {
+		return nil, err
+	}
+
+	config.OnReload(func(v *viper.Viper) {
+		if err := r.build(v); err != nil {
+			r.logger.Error().Err(err).Msg("failed to rebuild upstream clients, keeping previous ones")
+			return
+		}
+		r.logger.Info().Msg("upstream clients rebuilt")
+	})
+
+	if _, err := mp.Meter(config.AppName).Int64ObservableGauge("upstream.tls.certificate.expiry",
+		metric.WithDescription("Unix time at which the upstream TLS certificate expires"),
+		metric.WithUnit("s"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			r.certMu.Lock()
+			defer r.certMu.Unlock()
+
+			for k, cert := range r.certificates {
+				o.Observe(cert.NotAfter.Unix(), metric.WithAttributes(
+					attribute.String("provider", k.provider),
+					attribute.String("certificate", k.kind),
+					attribute.String("subject", cert.Subject.CommonName),
+				))
+			}
+			return nil
+		}),
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := mp.Meter(config.AppName).Int64ObservableGauge("upstream.circuit_breaker.state",
+		metric.WithDescription("Upstream circuit breaker state, 0 closed, 1 half open, 2 open"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for provider, b := range r.breakers {
+				o.Observe(int64(b.State()), metric.WithAttributes(attribute.String("provider", provider)))
+			}
+			return nil
+		}),
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := mp.Meter(config.AppName).Float64ObservableGauge("upstream.credentials.lockout",
+		metric.WithDescription("Remaining time logins to an upstream are suspended after it rejected the credentials, 0 when logins are allowed"),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for provider, l := range r.lockouts {
+				o.Observe(l.Remaining().Seconds(), metric.WithAttributes(attribute.String("provider", provider)))
+			}
+			return nil
+		}),
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := mp.Meter(config.AppName).Int64ObservableGauge("upstream.endpoint.healthy",
+		metric.WithDescription("Whether an upstream server URL passes its health checks, 1 healthy, 0 unhealthy"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			for provider, b := range r.balancers {
+				for _, e := range b.endpoints {
+					var healthy int64
+					if e.healthy.Load() {
+						healthy = 1
+					}
+					o.Observe(healthy, metric.WithAttributes(
+						attribute.String("provider", provider),
+						attribute.String("endpoint", e.url.String()),
+					))
+				}
+			}
+			return nil
+		}),
+	); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			for _, provider := range config.AllProviders {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r.runHealthChecks(ctx, provider)
+				}()
+			}
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			wg.Wait()
+			return nil
+		},
+	})
+
+	return r, nil
+}
+
+func (r *Registry) runHealthChecks(ctx context.Context, provider string) {
+	for {
+		v := config.Viper()
+		interval := v.GetDuration(config.ProviderKey(provider, config.KeySuffixHealthCheckInterval))
+		if interval <= 0 {
+			// checked again later in case a reload enables health checks
+			interval = time.Minute
+		} else {
+			r.mu.RLock()
+			b := r.balancers[provider]
+			r.mu.RUnlock()
+
+			if b != nil {
+				b.probe(ctx, v.GetDuration(config.ProviderKey(provider, config.KeySuffixTimeoutRequest)))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probe requests a lightweight unauthenticated endpoint of a provider, a
+// provider without a server URL is not configured and always passes. Probes
+// bypass the circuit breaker, retries and request metrics of the provider
+// client so that readiness reflects the upstream and not login traffic.
+func (r *Registry) probe(ctx context.Context, provider string) error {
+	r.mu.RLock()
+	client, b := r.probes[provider], r.balancers[provider]
+	r.mu.RUnlock()
+
+	if b == nil || b.primary == "" {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.primary+ProbePaths[provider], nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+type restyLogger struct {
+	logger zerolog.Logger
+}
+
+func (l restyLogger) Errorf(format string, v ...any) {
+	l.logger.Error().Msgf(format, v...)
+}
+
+func (l restyLogger) Warnf(format string, v ...any) {
+	l.logger.Warn().Msgf(format, v...)
+}
+
+func (l restyLogger) Debugf(format string, v ...any) {
+	l.logger.Debug().Msgf(format, v...)
+}
+
+func retryIdempotent(res *resty.Response, err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || res == nil || res.Request == nil {
+		return false
+	}
+
+	return isIdempotent(res.Request.Method) && (err != nil || res.StatusCode() >= http.StatusInternalServerError)
+}
+
+func (r *Registry) observer(provider string) func(kind string, cert *x509.Certificate) {
+	return func(kind string, cert *x509.Certificate) {
+		r.certMu.Lock()
+		defer r.certMu.Unlock()
+
+		r.certificates[certificateKey{provider: provider, kind: kind}] = cert
+	}
+}
+
+func (r *Registry) build(v *viper.Viper) error {
+	clients := make(map[string]*resty.Client, len(config.AllProviders))
+	probes := make(map[string]*http.Client, len(config.AllProviders))
+	balancers := make(map[string]*balancer, len(config.AllProviders))
+	transports := make([]*http.Transport, 0, len(config.AllProviders))
+
+	for _, provider := range config.AllProviders {
+		tlsConfig, err := newTLSConfig(v, provider, r.observer(provider))
+		if err != nil {
+			return err
+		}
+
+		connectTimeout := v.GetDuration(config.ProviderKey(provider, config.KeySuffixTimeoutConnect))
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		transport.Proxy = newProxyFunc(v, provider)
+		transport.DialContext = (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = connectTimeout
+		transports = append(transports, transport)
+
+		r.mu.RLock()
+		previous := r.balancers[provider]
+		r.mu.RUnlock()
+
+		lb, err := newBalancer(r.logger, provider, config.ServerURLs(v, provider),
+			v.GetString(config.ProviderKey(provider, config.KeySuffixBalancing)) == config.BalancingRoundRobin, previous, transport)
+		if err != nil {
+			return err
+		}
+		balancers[provider] = lb
+		probes[provider] = &http.Client{
+			Transport: lb,
+			Timeout:   v.GetDuration(config.ProviderKey(provider, config.KeySuffixTimeoutRequest)),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		breaker := r.breakers[provider]
+		breaker.configure(
+			v.GetInt(config.ProviderKey(provider, config.KeySuffixCircuitBreakerFailureThreshold)),
+			v.GetDuration(config.ProviderKey(provider, config.KeySuffixCircuitBreakerOpenDuration)),
+		)
+		r.lockouts[provider].configure(
+			v.GetInt(config.ProviderKey(provider, config.KeySuffixLockoutThreshold)),
+			v.GetDuration(config.ProviderKey(provider, config.KeySuffixLockoutCooldown)),
+			v.GetDuration(config.ProviderKey(provider, config.KeySuffixLockoutMaxCooldown)),
+		)
+
+		clients[provider] = resty.NewWithClient(&http.Client{
+			Transport: otelhttp.NewTransport(
+				&metricsTransport{provider: provider, duration: r.duration, next: &breakerTransport{breaker: breaker, next: lb}},
+				otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
+					return otelhttptrace.NewClientTrace(ctx)
+				}),
+				otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+					return provider + " " + req.Method + " " + req.URL.Path
+				}),
+				otelhttp.WithSpanOptions(trace.WithAttributes(attribute.String("provider", provider))),
+			),
+		}).
+			SetLogger(restyLogger{logger: r.logger.With().Str("provider", provider).Logger()}).
+			SetTimeout(v.GetDuration(config.ProviderKey(provider, config.KeySuffixTimeoutRequest))).
+			SetRetryCount(v.GetInt(config.ProviderKey(provider, config.KeySuffixRetryCount))).
+			SetRetryWaitTime(v.GetDuration(config.ProviderKey(provider, config.KeySuffixRetryWait))).
+			SetRetryMaxWaitTime(v.GetDuration(config.ProviderKey(provider, config.KeySuffixRetryMaxWait))).
+			AddRetryCondition(retryIdempotent)
+	}
+
+	r.mu.Lock()
+	old := r.transports
+	r.clients, r.probes, r.balancers, r.transports = clients, probes, balancers, transports
+	r.mu.Unlock()
+
+	for _, t := range old {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (r *Registry) Breaker(provider string) *Breaker {
+	return r.breakers[provider]
+}
+
+func (r *Registry) Lockout(provider string) *Lockout {
+	return r.lockouts[provider]
+}
+
+func (r *Registry) Client(provider string) *resty.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.clients[provider]
+}
+
+// ServerURL returns the base URL requests to a provider are built against.
+// Requests are sent to whichever of its server URLs is selected.
+func (r *Registry) ServerURL(provider string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if b := r.balancers[provider]; b != nil {
+		return b.primary
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/viper"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/fx/fxtest"
+
+	"github.com/wei840222/ory-oathkeeper-login/config"
+	"github.com/wei840222/ory-oathkeeper-login/server"
+)
+
+// newTestRegistry builds a registry from the defaults overridden by settings.
+func newTestRegistry(t *testing.T, settings map[string]any) (*Registry, *sdkmetric.ManualReader) {
+	t.Helper()
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	if err := config.InitViper(); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+
+	reader := sdkmetric.NewManualReader()
+	lc := fxtest.NewLifecycle(t)
+	r, err := NewRegistry(lc, sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), server.NewHealth(lc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, reader
+}
+
+func TestProbeBypassesBreakerRetriesAndMetrics(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if req.URL.Path != ProbePaths[config.ProviderArgoCD] {
+			t.Errorf("probed %s", req.URL.Path)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	r, reader := newTestRegistry(t, map[string]any{
+		config.ProviderKey(config.ProviderArgoCD, config.KeySuffixServerURL):                      srv.URL,
+		config.ProviderKey(config.ProviderArgoCD, config.KeySuffixCircuitBreakerFailureThreshold): 1,
+		config.ProviderKey(config.ProviderArgoCD, config.KeySuffixRetryCount):                     3,
+	})
+
+	for range 3 {
+		if err := r.probe(context.Background(), config.ProviderArgoCD); err == nil {
+			t.Error("probe() passed on a 503")
+		}
+	}
+
+	if n := requests.Load(); n != 3 {
+		t.Errorf("upstream got %d requests for 3 probes, want no retries", n)
+	}
+	if state := r.breakers[config.ProviderArgoCD].State(); state != BreakerClosed {
+		t.Errorf("circuit breaker state = %v, want probes not to count", state)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "upstream.request.duration" {
+				t.Errorf("probes were recorded as upstream requests: %+v", m.Data)
+			}
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		wantErr bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"unauthorized is reachable", http.StatusUnauthorized, false},
+		{"redirect is reachable", http.StatusFound, false},
+		{"server error", http.StatusBadGateway, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tt.code == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			r, _ := newTestRegistry(t, map[string]any{
+				config.ProviderKey(config.ProviderN8N, config.KeySuffixServerURL): srv.URL,
+			})
+			if err := r.probe(context.Background(), config.ProviderN8N); (err != nil) != tt.wantErr {
+				t.Errorf("probe() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	r, _ := newTestRegistry(t, nil)
+	if err := r.probe(context.Background(), config.ProviderNocoDB); err != nil {
+		t.Errorf("probe() of an unconfigured provider = %v", err)
+	}
+}
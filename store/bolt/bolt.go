@@ -0,0 +1,432 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	lib_store "github.com/eko/gocache/lib/v4/store"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	BoltType = "bolt"
+
+	compactTxMaxSize = 64 << 20
+
+	reopenAttempts = 3
+	reopenBackoff  = 100 * time.Millisecond
+)
+
+var (
+	entriesBucket = []byte("entries")
+	tagsBucket    = []byte("tags")
+
+	// openDB is replaced in tests to make reopening fail
+	openDB = open
+)
+
+type BoltStore struct {
+	mu sync.RWMutex
+	db *bbolt.DB
+	// err is set when the database could not be reopened after a compaction,
+	// db is nil then and every operation fails with it
+	err     error
+	path    string
+	options *lib_store.Options
+}
+
+func NewBolt(path string, options ...lib_store.Option) (*BoltStore, error) {
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{
+		db:      db,
+		path:    path,
+		options: lib_store.ApplyOptions(options...),
+	}, nil
+}
+
+func open(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt store %s: %w", path, err)
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(entriesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(tagsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// entries are stored as an 8 byte big endian unix nano expiry (0 = never) followed by the raw value
+func encode(value []byte, expiration time.Duration) []byte {
+	var expiresAt int64
+	if expiration > 0 {
+		expiresAt = time.Now().Add(expiration).UnixNano()
+	}
+
+	b := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(b, uint64(expiresAt))
+	copy(b[8:], value)
+	return b
+}
+
+func decode(b []byte) ([]byte, time.Time, bool) {
+	if len(b) < 8 {
+		return nil, time.Time{}, false
+	}
+
+	var expiresAt time.Time
+	if n := int64(binary.BigEndian.Uint64(b)); n > 0 {
+		expiresAt = time.Unix(0, n)
+	}
+	return b[8:], expiresAt, true
+}
+
+// handle returns the open database, the caller must hold s.mu.
+func (s *BoltStore) handle() (*bbolt.DB, error) {
+	if s.db == nil {
+		return nil, s.err
+	}
+	return s.db, nil
+}
+
+// reopen opens s.path again after s.db was closed, retrying briefly. If the
+// file cannot be opened the store is marked as unusable so that Ping fails.
+func (s *BoltStore) reopen() error {
+	var err error
+	for attempt := range reopenAttempts {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * reopenBackoff)
+		}
+
+		var db *bbolt.DB
+		if db, err = openDB(s.path); err == nil {
+			s.db, s.err = db, nil
+			return nil
+		}
+	}
+
+	s.db, s.err = nil, fmt.Errorf("bolt store is unusable: %w", err)
+	return s.err
+}
+
+func toBytes(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T for bolt store", v)
+	}
+}
+
+func (s *BoltStore) Get(ctx context.Context, key any) (any, error) {
+	value, _, err := s.GetWithTTL(ctx, key)
+	return value, err
+}
+
+func (s *BoltStore) GetWithTTL(_ context.Context, key any) (any, time.Duration, error) {
+	k, err := toBytes(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		value     string
+		expiresAt time.Time
+		found     bool
+	)
+	db, err := s.handle()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := db.View(func(tx *bbolt.Tx) error {
+		v, e, ok := decode(tx.Bucket(entriesBucket).Get(k))
+		if !ok || (!e.IsZero() && time.Now().After(e)) {
+			return nil
+		}
+		value, expiresAt, found = string(v), e, true
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	if !found {
+		return nil, 0, lib_store.NotFoundWithCause(errors.New("value not found in bolt store"))
+	}
+
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = time.Until(expiresAt)
+	}
+	return value, ttl, nil
+}
+
+func (s *BoltStore) Set(_ context.Context, key any, value any, options ...lib_store.Option) error {
+	opts := lib_store.ApplyOptionsWithDefault(s.options, options...)
+
+	k, err := toBytes(key)
+	if err != nil {
+		return err
+	}
+	v, err := toBytes(value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	db, err := s.handle()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(entriesBucket).Put(k, encode(v, opts.Expiration)); err != nil {
+			return err
+		}
+
+		for _, tag := range opts.Tags {
+			b, err := tx.Bucket(tagsBucket).CreateBucketIfNotExists([]byte(tag))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Delete(_ context.Context, key any) error {
+	k, err := toBytes(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	db, err := s.handle()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete(k)
+	})
+}
+
+func (s *BoltStore) Invalidate(_ context.Context, options ...lib_store.InvalidateOption) error {
+	opts := lib_store.ApplyInvalidateOptions(options...)
+	if len(opts.Tags) == 0 {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	db, err := s.handle()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		entries, tags := tx.Bucket(entriesBucket), tx.Bucket(tagsBucket)
+		for _, tag := range opts.Tags {
+			b := tags.Bucket([]byte(tag))
+			if b == nil {
+				continue
+			}
+			if err := b.ForEach(func(k, _ []byte) error {
+				return entries.Delete(k)
+			}); err != nil {
+				return err
+			}
+			if err := tags.DeleteBucket([]byte(tag)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Clear(_ context.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	db, err := s.handle()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, tagsBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) GetType() string {
+	return BoltType
+}
+
+// Sweep deletes every expired entry and returns how many were removed.
+func (s *BoltStore) Sweep(_ context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	db, err := s.handle()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	now := time.Now()
+	err = db.Update(func(tx *bbolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+
+		var expired [][]byte
+		if err := entries.ForEach(func(k, v []byte) error {
+			if _, e, ok := decode(v); !ok || (!e.IsZero() && now.After(e)) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := entries.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+
+		tags := tx.Bucket(tagsBucket)
+		return tags.ForEachBucket(func(tag []byte) error {
+			b := tags.Bucket(tag)
+			var stale [][]byte
+			if err := b.ForEach(func(k, _ []byte) error {
+				if entries.Get(k) == nil {
+					stale = append(stale, append([]byte(nil), k...))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, k := range stale {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+
+	return removed, err
+}
+
+// Compact rewrites the database into a fresh file so that pages freed by
+// deleted entries are returned to the filesystem.
+func (s *BoltStore) Compact(_ context.Context) (before int64, after int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db, err := s.handle()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if fi, err := os.Stat(s.path); err == nil {
+		before = fi.Size()
+	}
+
+	tmpPath := s.path + ".compact"
+	os.Remove(tmpPath)
+
+	dst, err := bbolt.Open(tmpPath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return before, before, err
+	}
+	if err := bbolt.Compact(dst, db, compactTxMaxSize); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return before, before, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return before, before, err
+	}
+
+	if err := db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return before, before, err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		// the original file is untouched, reopen it so the store keeps working
+		return before, before, errors.Join(err, s.reopen())
+	}
+
+	if err := s.reopen(); err != nil {
+		return before, 0, err
+	}
+
+	if fi, err := os.Stat(s.path); err == nil {
+		after = fi.Size()
+	}
+	return before, after, nil
+}
+
+// Ping checks that the database is open and readable, it fails for good once
+// the database could not be reopened after a compaction.
+func (s *BoltStore) Ping(_ context.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	db, err := s.handle()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(entriesBucket) == nil {
+			return errors.New("entries bucket is missing")
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,277 @@
+package bolt
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	lib_store "github.com/eko/gocache/lib/v4/store"
+	"go.etcd.io/bbolt"
+)
+
+func newTestStore(t *testing.T) *BoltStore {
+	t.Helper()
+
+	s, err := NewBolt(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, &lib_store.NotFound{})
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		expiration time.Duration
+		wantExpiry bool
+	}{
+		{"no expiry", "value", 0, false},
+		{"expiry", "value", time.Minute, true},
+		{"empty value", "", time.Minute, true},
+		{"negative expiration never expires", "value", -time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			value, expiresAt, ok := decode(encode([]byte(tt.value), tt.expiration))
+			if !ok || string(value) != tt.value {
+				t.Fatalf("decode() = %q, %v, want %q", value, ok, tt.value)
+			}
+			if expiresAt.IsZero() == tt.wantExpiry {
+				t.Fatalf("expiresAt = %v, want expiry %v", expiresAt, tt.wantExpiry)
+			}
+			if tt.wantExpiry && (expiresAt.Before(start.Add(tt.expiration)) || expiresAt.After(time.Now().Add(tt.expiration))) {
+				t.Errorf("expiresAt = %v, want about %s from now", expiresAt, tt.expiration)
+			}
+		})
+	}
+
+	if _, _, ok := decode([]byte{1, 2, 3}); ok {
+		t.Error("decode() accepted a value shorter than the expiry header")
+	}
+}
+
+func TestGetWithTTL(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	if err := s.Set(ctx, "forever", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "minute", "b", lib_store.WithExpiration(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "expired", "c", lib_store.WithExpiration(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	tests := []struct {
+		key      string
+		want     any
+		wantTTL  bool
+		notFound bool
+	}{
+		{key: "forever", want: "a"},
+		{key: "minute", want: "b", wantTTL: true},
+		{key: "expired", notFound: true},
+		{key: "missing", notFound: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			value, ttl, err := s.GetWithTTL(ctx, tt.key)
+			if tt.notFound {
+				if !isNotFound(err) {
+					t.Errorf("GetWithTTL() = %v, %v, want not found", value, err)
+				}
+				return
+			}
+			if err != nil || value != tt.want {
+				t.Fatalf("GetWithTTL() = %v, %v, want %v", value, err, tt.want)
+			}
+			if tt.wantTTL != (ttl > 0) || ttl > time.Minute {
+				t.Errorf("ttl = %s", ttl)
+			}
+		})
+	}
+
+	if _, err := s.Get(ctx, 42); err == nil || isNotFound(err) {
+		t.Errorf("Get() with an int key = %v, want an unsupported type error", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	for key, expiration := range map[string]time.Duration{
+		"expired-1": time.Millisecond,
+		"expired-2": time.Millisecond,
+		"live":      time.Minute,
+		"forever":   0,
+	} {
+		if err := s.Set(ctx, key, "v", lib_store.WithExpiration(expiration), lib_store.WithTags([]string{"tag"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	removed, err := s.Sweep(ctx)
+	if err != nil || removed != 2 {
+		t.Fatalf("Sweep() = %d, %v, want 2", removed, err)
+	}
+	if removed, err := s.Sweep(ctx); err != nil || removed != 0 {
+		t.Errorf("second Sweep() = %d, %v, want 0", removed, err)
+	}
+
+	var tagged []string
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tagsBucket).Bucket([]byte("tag")).ForEach(func(k, _ []byte) error {
+			tagged = append(tagged, string(k))
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tagged, ",") != "forever,live" {
+		t.Errorf("tag index = %v, want the swept keys removed", tagged)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	for key, tags := range map[string][]string{
+		"a": {"proxmox"},
+		"b": {"proxmox", "ghost"},
+		"c": {"ghost"},
+		"d": nil,
+	} {
+		if err := s.Set(ctx, key, "v", lib_store.WithTags(tags)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Invalidate(ctx, lib_store.WithInvalidateTags([]string{"proxmox", "unknown"})); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"a": false, "b": false, "c": true, "d": true} {
+		if _, err := s.Get(ctx, key); (err == nil) != want {
+			t.Errorf("Get(%q) = %v, want present %v", key, err, want)
+		}
+	}
+
+	// invalidating without tags is a no-op
+	if err := s.Invalidate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "c"); err != nil {
+		t.Errorf("Get(c) = %v after an invalidation without tags", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	value := strings.Repeat("x", 4096)
+	for i := range 500 {
+		if err := s.Set(ctx, strconv.Itoa(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 490 {
+		if err := s.Delete(ctx, strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, after, err := s.Compact(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Errorf("Compact() = %d, %d, want the file to shrink", before, after)
+	}
+
+	if got, err := s.Get(ctx, "499"); err != nil || got != value {
+		t.Errorf("Get() after compaction = %v", err)
+	}
+	if err := s.Set(ctx, "new", "v"); err != nil {
+		t.Errorf("Set() after compaction = %v", err)
+	}
+	if err := s.Ping(ctx); err != nil {
+		t.Errorf("Ping() after compaction = %v", err)
+	}
+}
+
+func TestCompactReopenFails(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	if err := s.Set(ctx, "key", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts int
+	openDB = func(string) (*bbolt.DB, error) {
+		attempts++
+		return nil, errors.New("disk full")
+	}
+	t.Cleanup(func() { openDB = open })
+
+	if _, _, err := s.Compact(ctx); err == nil {
+		t.Fatal("Compact() succeeded without reopening the database")
+	}
+	if attempts != reopenAttempts {
+		t.Errorf("reopened %d times, want %d", attempts, reopenAttempts)
+	}
+
+	if err := s.Ping(ctx); err == nil {
+		t.Error("Ping() succeeded on an unusable store")
+	}
+	if _, err := s.Get(ctx, "key"); err == nil || isNotFound(err) {
+		t.Errorf("Get() = %v, want the reopen error", err)
+	}
+	if err := s.Set(ctx, "key", "v"); err == nil {
+		t.Error("Set() succeeded on an unusable store")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	if err := s.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket(entriesBucket)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(ctx); err == nil {
+		t.Error("Ping() succeeded without the entries bucket")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(ctx); err == nil {
+		t.Error("Ping() succeeded on a closed database")
+	}
+}